@@ -1,8 +1,12 @@
 package config
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var (
@@ -13,16 +17,136 @@ var (
 	GitlabURL      = getEnv("GITLAB_URL", "https://gitlab.com/")
 	GitEmail       = getEnv("GIT_EMAIL", "vcs@example.com")
 	GitUser        = getEnv("GIT_USER", "vcs")
+	GitTransport   = getEnv("GIT_TRANSPORT", GitTransportSSH)
+	Forge          = getEnv("FORGE", ForgeGitLab)
+	GithubToken    = getEnv("GITHUB_TOKEN", "")
+	GithubURL      = getEnv("GITHUB_URL", "https://github.com/")
+	GithubAPIURL   = getEnv("GITHUB_API_URL", "https://api.github.com")
 	SecretToken    = getEnv("SECRET_TOKEN", "")
+	CommandPrefix  = getEnv("COMMAND_PREFIX", "/combine")
+	StepTimeout    = getEnvDuration("STEP_TIMEOUT", 5*time.Minute)
+	RunTimeout     = getEnvDuration("RUN_TIMEOUT", 30*time.Minute)
+	WorkDir        = getEnv("WORK_DIR", "/gitlab-combiner")
+
+	SSHPrivateKey       = getEnv("SSH_PRIVATE_KEY", "")
+	SSHPrivateKeyFile   = getEnv("SSH_PRIVATE_KEY_FILE", "")
+	SSHKnownHosts       = getEnv("SSH_KNOWN_HOSTS", "")
+	SSHKnownHostsFile   = getEnv("SSH_KNOWN_HOSTS_FILE", "")
+	SSHHostFingerprints = getEnvList("SSH_HOST_FINGERPRINTS")
+	SSHHost             = getEnv("SSH_HOST", "")
+
+	APIMaxRetries = getEnvInt("API_MAX_RETRIES", 3)
+	APIRetryDelay = getEnvDuration("API_RETRY_DELAY", 500*time.Millisecond)
+	APIMaxDelay   = getEnvDuration("API_RETRY_MAX_DELAY", 30*time.Second)
+	APIRateLimit  = getEnvInt("API_RATE_LIMIT", 10)
+	APITimeout    = getEnvDuration("API_TIMEOUT", 30*time.Second)
+
+	TokenCheckInterval     = getEnvDuration("TOKEN_CHECK_INTERVAL", 6*time.Hour)
+	TokenExpiryWarningDays = getEnvInt("TOKEN_EXPIRY_WARNING_DAYS", 14)
+
+	GitlabProxy      = getEnv("GITLAB_PROXY", "")
+	GitlabCABundles  = getEnvList("GITLAB_CA_BUNDLE")
+	GitlabClientCert = getEnv("GITLAB_CLIENT_CERT", "")
+	GitlabClientKey  = getEnv("GITLAB_CLIENT_KEY", "")
+
+	TriggerOnSourcePush        = getEnvBool("TRIGGER_ON_SOURCE_PUSH", false)
+	TriggerOnDefaultBranchPush = getEnvBool("TRIGGER_ON_DEFAULT_BRANCH_PUSH", false)
+	RefreshDelay               = getEnvDuration("REFRESH_DELAY", 30*time.Second)
+
+	MaxConcurrentCombines   = getEnvInt("MAX_CONCURRENT_COMBINES", 4)
+	MaxCombinesPerNamespace = getEnvInt("MAX_COMBINES_PER_NAMESPACE", 0)
+	QueueSize               = getEnvInt("QUEUE_SIZE", 50)
+
+	DedupTTL        = getEnvDuration("DEDUP_TTL", time.Hour)
+	DedupMaxEntries = getEnvInt("DEDUP_MAX_ENTRIES", 10000)
+
+	LockBackend = getEnv("LOCK_BACKEND", "memory")
+	LockDir     = getEnv("LOCK_DIR", WorkDir+"/locks")
+	LockTTL     = getEnvDuration("LOCK_TTL", RunTimeout+5*time.Minute)
+	ReplicaID   = getEnv("REPLICA_ID", hostname())
+
+	ProjectAllowlist = getEnvList("PROJECT_ALLOWLIST")
+
+	MinAccessLevel = getEnv("MIN_ACCESS_LEVEL", "developer")
+	AllowedUsers   = getEnvList("ALLOWED_USERS")
+	AllowedGroups  = getEnvList("ALLOWED_GROUPS")
+	AuditLogFile   = getEnv("AUDIT_LOG_FILE", "")
 )
 
+const (
+	GitTransportSSH   = "ssh"
+	GitTransportHTTPS = "https"
+
+	ForgeGitLab = "gitlab"
+	ForgeGitHub = "github"
+)
+
+// ForgeURL is the web URL of the forge the repositories are cloned from.
+func ForgeURL() string {
+	if Forge == ForgeGitHub {
+		return GithubURL
+	}
+	return GitlabURL
+}
+
+var accessLevels = map[string]int{
+	"none":       0,
+	"guest":      10,
+	"reporter":   20,
+	"developer":  30,
+	"maintainer": 40,
+	"owner":      50,
+}
+
+// AccessLevel converts a GitLab role name or numeric access level.
+func AccessLevel(value string) (int, error) {
+	if level, ok := accessLevels[strings.ToLower(value)]; ok {
+		return level, nil
+	}
+	level, err := strconv.Atoi(value)
+	if err != nil || level < 0 {
+		return 0, fmt.Errorf("unknown access level %q", value)
+	}
+	return level, nil
+}
+
+// AccessLevelName returns the GitLab role for level, or the number itself.
+func AccessLevelName(level int) string {
+	for name, value := range accessLevels {
+		if value == level {
+			return strings.ToUpper(name[:1]) + name[1:]
+		}
+	}
+	return strconv.Itoa(level)
+}
+
 func ValidateEnvVars() {
+	if err := LoadProfiles(); err != nil {
+		log.Fatalf("Invalid profiles: %v", err)
+	}
+
+	if _, err := time.LoadLocation(ScheduleTZ); err != nil {
+		log.Fatalf("Invalid SCHEDULE_TIMEZONE: %v", err)
+	}
+
+	if Forge != ForgeGitLab && Forge != ForgeGitHub {
+		log.Fatalf("FORGE must be gitlab or github, got %q", Forge)
+	}
+
 	required := map[string]string{
-		"TRIGGER_MESSAGE": TriggerMessage,
-		"TRIGGER_TAG":     TriggerTag,
-		"TARGET_BRANCH":   TargetBranch,
-		"GITLAB_TOKEN":    GitlabToken,
-		"GITLAB_URL":      GitlabURL,
+		"GITLAB_TOKEN": GitlabToken,
+		"GITLAB_URL":   GitlabURL,
+	}
+	if Forge == ForgeGitHub {
+		required = map[string]string{
+			"GITHUB_TOKEN":   GithubToken,
+			"GITHUB_API_URL": GithubAPIURL,
+		}
+	}
+	if len(configuredProfiles) == 0 {
+		required["TRIGGER_MESSAGE"] = TriggerMessage
+		required["TRIGGER_TAG"] = TriggerTag
+		required["TARGET_BRANCH"] = TargetBranch
 	}
 
 	for key, value := range required {
@@ -30,6 +154,58 @@ func ValidateEnvVars() {
 			log.Fatalf("Missing required env variable: %s", key)
 		}
 	}
+
+	if GitTransport != GitTransportSSH && GitTransport != GitTransportHTTPS {
+		log.Fatalf("GIT_TRANSPORT must be ssh or https, got %q", GitTransport)
+	}
+
+	if (GitlabClientCert == "") != (GitlabClientKey == "") {
+		log.Fatalf("GITLAB_CLIENT_CERT and GITLAB_CLIENT_KEY must be set together")
+	}
+
+	if StepTimeout <= 0 || RunTimeout <= 0 {
+		log.Fatalf("STEP_TIMEOUT and RUN_TIMEOUT must be positive durations")
+	}
+
+	if TokenCheckInterval <= 0 {
+		log.Fatalf("TOKEN_CHECK_INTERVAL must be a positive duration")
+	}
+
+	if MaxConcurrentCombines <= 0 {
+		log.Fatalf("MAX_CONCURRENT_COMBINES must be greater than zero")
+	}
+
+	if _, err := AccessLevel(MinAccessLevel); err != nil {
+		log.Fatalf("Invalid MIN_ACCESS_LEVEL: %v", err)
+	}
+
+	if LockTTL <= RunTimeout {
+		log.Fatalf("LOCK_TTL (%s) must be longer than RUN_TIMEOUT (%s)", LockTTL, RunTimeout)
+	}
+}
+
+// ProjectAllowed reports whether PROJECT_ALLOWLIST lets the project be
+// combined. Entries are project IDs or paths with namespace; an empty list
+// allows every project.
+func ProjectAllowed(projectID int, pathWithNamespace string) bool {
+	if len(ProjectAllowlist) == 0 {
+		return true
+	}
+
+	for _, entry := range ProjectAllowlist {
+		if entry == strconv.Itoa(projectID) || strings.EqualFold(entry, pathWithNamespace) {
+			return true
+		}
+	}
+	return false
+}
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "gitlab-mr-combiner"
+	}
+	return name
 }
 
 func getEnv(key, defaultValue string) string {
@@ -38,3 +214,55 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+func getEnvList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	value, exists := os.LookupEnv(key)
+	if !exists || value == "" {
+		return defaultValue
+	}
+
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid boolean for %s: %q, using default %t", key, value, defaultValue)
+		return defaultValue
+	}
+	return enabled
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	value, exists := os.LookupEnv(key)
+	if !exists || value == "" {
+		return defaultValue
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid integer for %s: %q, using default %d", key, value, defaultValue)
+		return defaultValue
+	}
+	return number
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value, exists := os.LookupEnv(key)
+	if !exists || value == "" {
+		return defaultValue
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid duration for %s: %q, using default %s", key, value, defaultValue)
+		return defaultValue
+	}
+	return duration
+}
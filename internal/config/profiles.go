@@ -0,0 +1,158 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+	_ "time/tzdata"
+
+	"gitlab-mr-combiner/internal/schedule"
+)
+
+// Profile describes one combined branch: the MRs carrying Label are merged
+// into TargetBranch, and TriggerMessage posted on an MR starts a rebuild.
+// With Schedule set, Projects are also rebuilt on that cron schedule.
+type Profile struct {
+	Name           string         `json:"name"`
+	Label          string         `json:"label"`
+	TargetBranch   string         `json:"target_branch"`
+	TriggerMessage string         `json:"trigger_message"`
+	Schedule       string         `json:"schedule"`
+	Projects       []int          `json:"projects"`
+	FreezeWindows  []FreezeWindow `json:"freeze_windows"`
+
+	schedule *schedule.Schedule
+	freezes  []*schedule.Window
+}
+
+// FreezeWindow blocks automatic rebuilds for Duration after every
+// activation of the Start cron expression.
+type FreezeWindow struct {
+	Start    string `json:"start"`
+	Duration string `json:"duration"`
+}
+
+const defaultProfileName = "default"
+
+var (
+	ProfilesJSON = getEnv("PROFILES", "")
+	ProfilesFile = getEnv("PROFILES_FILE", "")
+	ScheduleTZ   = getEnv("SCHEDULE_TIMEZONE", "UTC")
+
+	configuredProfiles []Profile
+)
+
+// Profiles returns the profiles from PROFILES/PROFILES_FILE, or a single
+// default profile built from TRIGGER_TAG, TARGET_BRANCH and TRIGGER_MESSAGE.
+func Profiles() []Profile {
+	if len(configuredProfiles) > 0 {
+		return configuredProfiles
+	}
+	return []Profile{{
+		Name:           defaultProfileName,
+		Label:          TriggerTag,
+		TargetBranch:   TargetBranch,
+		TriggerMessage: TriggerMessage,
+	}}
+}
+
+func (p Profile) IsDefault() bool {
+	return p.Name == defaultProfileName && len(configuredProfiles) == 0
+}
+
+func LoadProfiles() error {
+	data := []byte(ProfilesJSON)
+	if ProfilesFile != "" {
+		fileData, err := os.ReadFile(ProfilesFile)
+		if err != nil {
+			return fmt.Errorf("error reading PROFILES_FILE: %v", err)
+		}
+		data = fileData
+	}
+
+	if len(data) == 0 {
+		configuredProfiles = nil
+		return nil
+	}
+
+	var profiles []Profile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return fmt.Errorf("error parsing profiles: %v", err)
+	}
+
+	branches := map[string]string{}
+	for i := range profiles {
+		profile := &profiles[i]
+		if profile.Label == "" || profile.TargetBranch == "" {
+			return fmt.Errorf("profile #%d must set label and target_branch", i+1)
+		}
+		if profile.Name == "" {
+			profile.Name = profile.Label
+		}
+		if profile.TriggerMessage == "" {
+			profile.TriggerMessage = TriggerMessage
+		}
+		if err := profile.parseSchedules(); err != nil {
+			return fmt.Errorf("profile %q: %v", profile.Name, err)
+		}
+		if other, ok := branches[profile.TargetBranch]; ok {
+			return fmt.Errorf("profiles %q and %q both target branch %s", other, profile.Name, profile.TargetBranch)
+		}
+		branches[profile.TargetBranch] = profile.Name
+	}
+
+	configuredProfiles = profiles
+	return nil
+}
+
+func (p *Profile) parseSchedules() error {
+	if p.Schedule != "" {
+		if len(p.Projects) == 0 {
+			return fmt.Errorf("schedule requires a list of projects")
+		}
+
+		parsed, err := schedule.Parse(p.Schedule)
+		if err != nil {
+			return fmt.Errorf("invalid schedule: %v", err)
+		}
+		p.schedule = parsed
+	}
+
+	p.freezes = nil
+	for _, window := range p.FreezeWindows {
+		parsed, err := schedule.ParseWindow(window.Start, window.Duration)
+		if err != nil {
+			return fmt.Errorf("invalid freeze window: %v", err)
+		}
+		p.freezes = append(p.freezes, parsed)
+	}
+	return nil
+}
+
+func (p Profile) HasSchedule() bool {
+	return p.schedule != nil
+}
+
+// NextRun returns the next scheduled rebuild after t in SCHEDULE_TIMEZONE.
+func (p Profile) NextRun(t time.Time) time.Time {
+	return p.schedule.Next(t.In(ScheduleLocation()))
+}
+
+func (p Profile) Frozen(t time.Time) bool {
+	t = t.In(ScheduleLocation())
+	for _, window := range p.freezes {
+		if window.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func ScheduleLocation() *time.Location {
+	loc, err := time.LoadLocation(ScheduleTZ)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
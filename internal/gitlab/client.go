@@ -2,43 +2,120 @@ package gitlab
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"gitlab-mr-combiner/internal/config"
+	"gitlab-mr-combiner/internal/metrics"
 	"io"
+	"math/rand/v2"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
+const listPageSize = 100
+
+var apiRetries = metrics.NewCounterVec("combiner_gitlab_retries_total", "Retried GitLab API requests", "method", "reason")
+
 type ApiClient struct {
 	client  *http.Client
 	baseURL string
 	token   string
+	forge   string
+
+	maxRetries int
+	retryDelay time.Duration
+	maxDelay   time.Duration
+	limiter    *rateLimiter
 }
 
-func NewApiClient() *ApiClient {
-	return &ApiClient{
-		client:  &http.Client{},
-		baseURL: fmt.Sprintf("%s/api/v4", config.GitlabURL),
-		token:   config.GitlabToken,
+func NewApiClient(options ...Option) *ApiClient {
+	api := &ApiClient{
+		client: &http.Client{
+			Transport: http.DefaultTransport.(*http.Transport).Clone(),
+			Timeout:   config.APITimeout,
+		},
+		baseURL:    fmt.Sprintf("%s/api/v4", strings.TrimSuffix(config.GitlabURL, "/")),
+		token:      config.GitlabToken,
+		forge:      config.ForgeGitLab,
+		maxRetries: config.APIMaxRetries,
+		retryDelay: config.APIRetryDelay,
+		maxDelay:   config.APIMaxDelay,
+		limiter:    newRateLimiter(config.APIRateLimit),
 	}
+	for _, option := range options {
+		option(api)
+	}
+	return api
 }
 
-func (api *ApiClient) Send(method, endpoint string, body interface{}) ([]byte, error) {
-	url := fmt.Sprintf("%s%s", api.baseURL, endpoint)
+func (api *ApiClient) Send(ctx context.Context, method, endpoint string, body interface{}) ([]byte, error) {
+	data, _, err := api.do(ctx, method, api.baseURL+endpoint, body)
+	return data, err
+}
 
-	var reqBody io.Reader
+func (api *ApiClient) do(ctx context.Context, method, url string, body interface{}) ([]byte, http.Header, error) {
+	return api.retrying(ctx, method, url, body, isIdempotent(method))
+}
+
+// retrying retries network errors and 5xx responses of idempotent requests
+// with jittered exponential backoff. A 429 is retried for every request,
+// since GitLab did not process it, after the Retry-After it asked for.
+func (api *ApiClient) retrying(ctx context.Context, method, url string, body interface{}, idempotent bool) ([]byte, http.Header, error) {
+	var jsonData []byte
 	if body != nil {
-		jsonData, err := json.Marshal(body)
-		if err != nil {
-			return nil, err
+		var err error
+		if jsonData, err = json.Marshal(body); err != nil {
+			return nil, nil, err
 		}
-		reqBody = bytes.NewBuffer(jsonData)
 	}
 
-	req, err := http.NewRequest(method, url, reqBody)
+	for attempt := 0; ; attempt++ {
+		data, header, status, err := api.attempt(ctx, method, url, jsonData)
+		if ctx.Err() != nil {
+			return nil, nil, context.Cause(ctx)
+		}
+
+		reason := ""
+		switch {
+		case err != nil && status == 0 && idempotent:
+			reason = "network"
+		case status == http.StatusTooManyRequests:
+			reason = "rate_limited"
+		case status >= 500 && idempotent:
+			reason = "server_error"
+		}
+		if reason == "" || attempt >= api.maxRetries {
+			return data, header, err
+		}
+
+		apiRetries.Inc(method, reason)
+		if reason == "rate_limited" {
+			api.limiter.pauseUntil(time.Now().Add(retryAfter(header, api.backoff(attempt))))
+			continue
+		}
+		if err := sleep(ctx, api.backoff(attempt)); err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+func (api *ApiClient) attempt(ctx context.Context, method, url string, body []byte) ([]byte, http.Header, int, error) {
+	if err := api.limiter.wait(ctx); err != nil {
+		return nil, nil, 0, err
+	}
+
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, reqBody)
 	if err != nil {
-		return nil, err
+		return nil, nil, 0, err
 	}
 
 	req.Header.Set("Content-Type", "application/json")
@@ -46,18 +123,156 @@ func (api *ApiClient) Send(method, endpoint string, body interface{}) ([]byte, e
 
 	resp, err := api.client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, nil, 0, err
 	}
 	defer resp.Body.Close()
 
+	if resp.Header.Get("RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(resp.Header.Get("RateLimit-Reset"), 10, 64); err == nil {
+			api.limiter.pauseUntil(time.Unix(reset, 0))
+		}
+	}
+
 	data, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return nil, nil, 0, err
 	}
 
 	if resp.StatusCode >= 400 {
-		return nil, errors.New(string(data))
+		return nil, resp.Header, resp.StatusCode, newAPIError(api.forge, method, url, resp, data)
+	}
+
+	return data, resp.Header, resp.StatusCode, nil
+}
+
+func (api *ApiClient) backoff(attempt int) time.Duration {
+	delay := api.retryDelay << attempt
+	if delay > api.maxDelay || delay <= 0 {
+		delay = api.maxDelay
 	}
+	return delay/2 + rand.N(delay/2+1)
+}
 
-	return data, nil
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryAfter reads Retry-After as seconds or an HTTP date.
+func retryAfter(header http.Header, fallback time.Duration) time.Duration {
+	value := header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return time.Until(at)
+	}
+	return fallback
+}
+
+// List fetches every page of a list endpoint. It follows the rel="next" Link
+// header, which also carries the cursor of keyset pagination (add
+// pagination=keyset to the endpoint where GitLab supports it), and falls back
+// to X-Next-Page for offset pagination.
+func List[T any](ctx context.Context, api *ApiClient, endpoint string) ([]T, error) {
+	pageURL, err := url.Parse(api.baseURL + endpoint)
+	if err != nil {
+		return nil, err
+	}
+	query := pageURL.Query()
+	if query.Get("per_page") == "" {
+		query.Set("per_page", fmt.Sprint(listPageSize))
+		pageURL.RawQuery = query.Encode()
+	}
+
+	var items []T
+	next := pageURL.String()
+	for next != "" {
+		data, header, err := api.do(ctx, http.MethodGet, next, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var page []T
+		if err := json.Unmarshal(data, &page); err != nil {
+			return nil, err
+		}
+		items = append(items, page...)
+
+		following, err := api.nextPage(next, header)
+		if err != nil {
+			return nil, err
+		}
+		if following == next {
+			return nil, fmt.Errorf("pagination of %s does not advance", endpoint)
+		}
+		next = following
+	}
+	return items, nil
+}
+
+func (api *ApiClient) nextPage(current string, header http.Header) (string, error) {
+	if link := nextLink(header.Values("Link")); link != "" {
+		if strings.HasPrefix(link, api.baseURL+"/") {
+			return link, nil
+		}
+		return api.rebase(link)
+	}
+
+	page := header.Get("X-Next-Page")
+	if page == "" {
+		return "", nil
+	}
+
+	pageURL, err := url.Parse(current)
+	if err != nil {
+		return "", err
+	}
+	query := pageURL.Query()
+	query.Set("page", page)
+	pageURL.RawQuery = query.Encode()
+	return pageURL.String(), nil
+}
+
+// rebase moves a next-page link onto baseURL. GitLab builds Link headers from
+// its external_url, which behind a proxy or with a differently spelled
+// GITLAB_URL need not match the host the client talks to; only the path and
+// query are taken over so the token is never sent elsewhere.
+func (api *ApiClient) rebase(link string) (string, error) {
+	base, err := url.Parse(api.baseURL)
+	if err != nil {
+		return "", err
+	}
+	linkURL, err := url.Parse(link)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(linkURL.EscapedPath(), base.EscapedPath()+"/") {
+		return "", fmt.Errorf("next page %s is outside of %s", link, api.baseURL)
+	}
+	linkURL.Scheme, linkURL.Host, linkURL.User = base.Scheme, base.Host, base.User
+	return linkURL.String(), nil
+}
+
+// nextLink extracts the rel="next" target of RFC 8288 Link headers.
+func nextLink(values []string) string {
+	for _, value := range values {
+		for _, link := range strings.Split(value, ",") {
+			target, params, ok := strings.Cut(strings.TrimSpace(link), ";")
+			if !ok || !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			for _, param := range strings.Split(params, ";") {
+				name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if name == "rel" && strings.Trim(value, `"`) == "next" {
+					return target[1 : len(target)-1]
+				}
+			}
+		}
+	}
+	return ""
 }
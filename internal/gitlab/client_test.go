@@ -0,0 +1,418 @@
+package gitlab
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab-mr-combiner/internal/config"
+)
+
+func TestListFollowsAllPages(t *testing.T) {
+	var server *httptest.Server
+	var requests []string
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.RawQuery)
+		query := r.URL.Query()
+		switch {
+		case query.Get("cursor") == "abc":
+			w.Write([]byte(`[{"iid": 5}]`))
+		case query.Get("page") == "2":
+			w.Header().Set("Link", fmt.Sprintf(`<%s/api/v4/projects/1/merge_requests?cursor=abc&per_page=2>; rel="next", <%s/api/v4/projects/1/merge_requests?page=1>; rel="first"`, server.URL, server.URL))
+			w.Write([]byte(`[{"iid": 3}, {"iid": 4}]`))
+		default:
+			w.Header().Set("X-Next-Page", "2")
+			w.Write([]byte(`[{"iid": 1}, {"iid": 2}]`))
+		}
+	}))
+	defer server.Close()
+
+	setGitlabURL(t, server.URL)
+	api := NewApiClient()
+
+	mergeRequests, err := List[MergeRequest](context.Background(), api, "/projects/1/merge_requests?state=opened")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	var iids []string
+	for _, mr := range mergeRequests {
+		iids = append(iids, fmt.Sprint(mr.IID))
+	}
+	if strings.Join(iids, ",") != "1,2,3,4,5" {
+		t.Errorf("Expected MRs from all pages, got %v", iids)
+	}
+	if len(requests) != 3 || !strings.Contains(requests[0], "per_page=100") || !strings.Contains(requests[1], "state=opened") {
+		t.Errorf("Unexpected page requests: %v", requests)
+	}
+}
+
+func TestListRebasesForeignNextLink(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.RequestURI())
+		if r.URL.Query().Get("page") == "2" {
+			w.Write([]byte(`[{"iid": 2}]`))
+			return
+		}
+		w.Header().Set("Link", `<https://gitlab.internal:8443/api/v4/projects?page=2&per_page=100>; rel="next"`)
+		w.Write([]byte(`[{"iid": 1}]`))
+	}))
+	defer server.Close()
+
+	setGitlabURL(t, server.URL)
+	mergeRequests, err := List[MergeRequest](context.Background(), NewApiClient(), "/projects")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(mergeRequests) != 2 {
+		t.Errorf("Expected both pages, got %v", mergeRequests)
+	}
+	if len(requests) != 2 || requests[1] != "/api/v4/projects?page=2&per_page=100" {
+		t.Errorf("Expected the next link to be rebased onto GITLAB_URL, got %v", requests)
+	}
+}
+
+func TestListRejectsNextLinkOutsideAPI(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", `<https://attacker.example/other/projects?page=2>; rel="next"`)
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	setGitlabURL(t, server.URL)
+	if _, err := List[MergeRequest](context.Background(), NewApiClient(), "/projects"); err == nil {
+		t.Error("Expected a next link outside of the API to be rejected")
+	}
+}
+
+func TestListWithTrailingSlashGitlabURL(t *testing.T) {
+	var server *httptest.Server
+	var paths []string
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if r.URL.Query().Get("page") == "2" {
+			w.Write([]byte(`[{"iid": 2}]`))
+			return
+		}
+		w.Header().Set("Link", fmt.Sprintf(`<%s/api/v4/projects?page=2>; rel="next"`, server.URL))
+		w.Write([]byte(`[{"iid": 1}]`))
+	}))
+	defer server.Close()
+
+	setGitlabURL(t, server.URL+"/")
+	mergeRequests, err := List[MergeRequest](context.Background(), NewApiClient(), "/projects")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(mergeRequests) != 2 || strings.Join(paths, ",") != "/api/v4/projects,/api/v4/projects" {
+		t.Errorf("Expected two pages under /api/v4, got %v from %v", mergeRequests, paths)
+	}
+}
+
+func TestSendRetries(t *testing.T) {
+	testCases := []struct {
+		name             string
+		method           string
+		failures         int
+		status           int
+		expectedAttempts int
+		expectError      bool
+		reason           string
+	}{
+		{name: "GET Retried on 503", method: "GET", failures: 2, status: http.StatusServiceUnavailable, expectedAttempts: 3, reason: "server_error"},
+		{name: "POST Not Retried on 503", method: "POST", failures: 1, status: http.StatusServiceUnavailable, expectedAttempts: 1, expectError: true},
+		{name: "POST Retried on 429", method: "POST", failures: 1, status: http.StatusTooManyRequests, expectedAttempts: 2, reason: "rate_limited"},
+		{name: "GET Gives Up", method: "GET", failures: 10, status: http.StatusBadGateway, expectedAttempts: 4, expectError: true, reason: "server_error"},
+		{name: "GET Not Retried on 404", method: "GET", failures: 1, status: http.StatusNotFound, expectedAttempts: 1, expectError: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			attempts := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts++
+				if attempts <= tc.failures {
+					w.Header().Set("Retry-After", "0")
+					w.WriteHeader(tc.status)
+					w.Write([]byte(`{"message": "try again"}`))
+					return
+				}
+				w.Write([]byte(`{}`))
+			}))
+			defer server.Close()
+
+			setGitlabURL(t, server.URL)
+			api := NewApiClient()
+			api.maxRetries, api.retryDelay, api.maxDelay = 3, time.Millisecond, 5*time.Millisecond
+
+			var before float64
+			if tc.reason != "" {
+				before = apiRetries.Value(tc.method, tc.reason)
+			}
+
+			_, err := api.Send(context.Background(), tc.method, "/projects/1", nil)
+			if (err != nil) != tc.expectError {
+				t.Errorf("Expected error=%v, got %v", tc.expectError, err)
+			}
+			if attempts != tc.expectedAttempts {
+				t.Errorf("Expected %d attempts, got %d", tc.expectedAttempts, attempts)
+			}
+			if tc.reason != "" {
+				if retries := apiRetries.Value(tc.method, tc.reason) - before; retries != float64(tc.expectedAttempts-1) {
+					t.Errorf("Expected %d retries to be counted, got %v", tc.expectedAttempts-1, retries)
+				}
+			}
+		})
+	}
+}
+
+func TestQueryRetriesServerErrors(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts <= 2 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{"data": {"project": {"id": "gid://gitlab/Project/1"}}}`))
+	}))
+	defer server.Close()
+
+	setGitlabURL(t, server.URL)
+	api := NewApiClient()
+	api.maxRetries, api.retryDelay, api.maxDelay = 3, time.Millisecond, 5*time.Millisecond
+
+	var result struct {
+		Project struct {
+			ID string `json:"id"`
+		} `json:"project"`
+	}
+	if err := api.Query(context.Background(), "query { project { id } }", nil, &result); err != nil || result.Project.ID == "" {
+		t.Fatalf("Expected the query to succeed after retries, got %+v, %v", result, err)
+	}
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestRateLimiterSpacesRequests(t *testing.T) {
+	limiter := newRateLimiter(100)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := limiter.wait(context.Background()); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("Expected 5 requests at 100/s to take at least 40ms, took %s", elapsed)
+	}
+
+	limiter.pauseUntil(time.Now().Add(time.Hour))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := limiter.wait(ctx); err == nil {
+		t.Error("Expected a paused limiter to wait past the deadline")
+	}
+}
+
+func TestSendReturnsAPIError(t *testing.T) {
+	testCases := []struct {
+		name            string
+		status          int
+		body            string
+		expectedMessage string
+		expectedHint    string
+		check           func(error) bool
+	}{
+		{name: "Not Found", status: 404, body: `{"message": "404 Project Not Found"}`, expectedMessage: "404 Project Not Found", expectedHint: "cannot see it", check: IsNotFound},
+		{name: "Insufficient Scope", status: 403, body: `{"error": "insufficient_scope", "error_description": "The request requires higher privileges than provided by the access token."}`, expectedMessage: "insufficient_scope: The request requires", expectedHint: "token lacks api scope", check: IsForbidden},
+		{name: "Validation Errors", status: 409, body: `{"message": {"source_branch": ["is invalid"], "base": ["Another open merge request already exists"]}}`, expectedMessage: "base Another open merge request already exists; source_branch is invalid", check: IsConflict},
+		{name: "HTML Error Page", status: 401, body: `<html><body>Unauthorized</body></html>`, expectedHint: "GITLAB_TOKEN is invalid", check: IsUnauthorized},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Request-Id", "req-1")
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			}))
+			defer server.Close()
+
+			setGitlabURL(t, server.URL)
+			_, err := NewApiClient().Send(context.Background(), "POST", "/projects/5/merge_requests?labels=x", nil)
+			wrapped := fmt.Errorf("Error fetching MRs: %w", err)
+
+			var apiErr *APIError
+			if !errors.As(wrapped, &apiErr) {
+				t.Fatalf("Expected an APIError, got %v", err)
+			}
+			if apiErr.StatusCode != tc.status || apiErr.Endpoint != "/projects/5/merge_requests" || apiErr.RequestID != "req-1" {
+				t.Errorf("Unexpected error fields: %+v", apiErr)
+			}
+			if !strings.HasPrefix(apiErr.Message, tc.expectedMessage) {
+				t.Errorf("Expected message %q, got %q", tc.expectedMessage, apiErr.Message)
+			}
+			if !strings.Contains(err.Error(), tc.expectedHint) || strings.Contains(err.Error(), "<html>") {
+				t.Errorf("Expected a readable error with hint %q, got %q", tc.expectedHint, err.Error())
+			}
+			if !tc.check(wrapped) {
+				t.Errorf("Expected status helper to match %d", tc.status)
+			}
+		})
+	}
+}
+
+func TestSendReturnsGitHubAPIError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"message": "Bad credentials"}`))
+	}))
+	defer server.Close()
+
+	_, err := NewApiClient(WithBaseURL(server.URL), WithForge(config.ForgeGitHub)).Send(context.Background(), "GET", "/user", nil)
+	if err == nil || !strings.HasPrefix(err.Error(), "GitHub API GET /user returned 401") || !strings.Contains(err.Error(), "GITHUB_TOKEN is invalid") {
+		t.Errorf("Expected the error to name GitHub and GITHUB_TOKEN, got %v", err)
+	}
+}
+
+func TestClientTransportOptions(t *testing.T) {
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer tlsServer.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsServer.Certificate().Raw})
+	if err := os.WriteFile(caFile, pemData, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	setGitlabURL(t, tlsServer.URL)
+	untrusted := NewApiClient()
+	untrusted.maxRetries = 0
+	if _, err := untrusted.Send(context.Background(), "GET", "/version", nil); err == nil {
+		t.Error("Expected the internal CA to be rejected without GITLAB_CA_BUNDLE")
+	}
+
+	tlsConfig, err := TLSConfig([]string{caFile}, "", "")
+	if err != nil {
+		t.Fatalf("Expected CA bundle to load, got %v", err)
+	}
+	if _, err := NewApiClient(WithTLSConfig(tlsConfig)).Send(context.Background(), "GET", "/version", nil); err != nil {
+		t.Errorf("Expected the internal CA to be trusted, got %v", err)
+	}
+
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		w.Write([]byte(`{}`))
+	}))
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	setGitlabURL(t, "http://gitlab.internal.example")
+	if _, err := NewApiClient(WithProxy(proxyURL)).Send(context.Background(), "GET", "/version", nil); err != nil {
+		t.Fatalf("Expected the request to go through the proxy, got %v", err)
+	}
+	if proxied != "http://gitlab.internal.example/api/v4/version" {
+		t.Errorf("Unexpected proxied request %q", proxied)
+	}
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	setGitlabURL(t, slow.URL)
+	api := NewApiClient(WithTimeout(20 * time.Millisecond))
+	api.maxRetries = 0
+	if _, err := api.Send(context.Background(), "GET", "/version", nil); err == nil {
+		t.Error("Expected the request timeout to apply")
+	}
+}
+
+func TestLabeledMergeRequestsPaginates(t *testing.T) {
+	var cursors []interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/graphql" || r.Method != http.MethodPost {
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		var request struct {
+			Variables map[string]interface{} `json:"variables"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		cursors = append(cursors, request.Variables["after"])
+		if request.Variables["fullPath"] != "group/app" {
+			t.Errorf("Unexpected project %v", request.Variables["fullPath"])
+		}
+
+		if request.Variables["after"] == nil {
+			w.Write([]byte(`{"data": {"project": {"mergeRequests": {"pageInfo": {"hasNextPage": true, "endCursor": "c1"}, "nodes": [
+				{"iid": "7", "title": "Feature", "description": "Adds a feature", "diffHeadSha": "abc123", "sourceBranch": "feature",
+				 "detailedMergeStatus": "MERGEABLE", "approved": false, "approvalsRequired": 2, "approvalsLeft": 1,
+				 "author": {"id": "gid://gitlab/User/42", "username": "alice"}, "labels": {"nodes": [{"title": "combine"}]},
+				 "headPipeline": {"id": "gid://gitlab/Ci::Pipeline/99", "status": "SUCCESS", "path": "/group/app/-/pipelines/99"}}]}}}}`))
+			return
+		}
+		w.Write([]byte(`{"data": {"project": {"mergeRequests": {"pageInfo": {"hasNextPage": false, "endCursor": "c2"}, "nodes": [{"iid": "8", "title": "Fix"}]}}}}`))
+	}))
+	defer server.Close()
+
+	setGitlabURL(t, server.URL)
+	mergeRequests, err := LabeledMergeRequests(context.Background(), NewApiClient(), "group/app", "combine")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(mergeRequests) != 2 || fmt.Sprint(cursors) != "[<nil> c1]" {
+		t.Fatalf("Expected two MRs over two pages, got %+v after cursors %v", mergeRequests, cursors)
+	}
+
+	mr := mergeRequests[0]
+	if mr.IID != 7 || mr.SHA != "abc123" || mr.Description != "Adds a feature" || mr.DetailedMergeStatus != "mergeable" || mr.Author.ID != 42 {
+		t.Errorf("Unexpected merge request %+v", mr)
+	}
+	if mr.Approvals == nil || mr.Approvals.Left != 1 || mr.Approvals.Required != 2 {
+		t.Errorf("Unexpected approvals %+v", mr.Approvals)
+	}
+	if mr.HeadPipeline == nil || mr.HeadPipeline.ID != 99 || mr.HeadPipeline.Status != "success" || mr.HeadPipeline.WebURL != server.URL+"/group/app/-/pipelines/99" {
+		t.Errorf("Unexpected head pipeline %+v", mr.HeadPipeline)
+	}
+}
+
+func TestIsGraphQLUnsupported(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"errors": [{"message": "Field 'detailedMergeStatus' doesn't exist on type 'MergeRequest'"}]}`))
+	}))
+	defer server.Close()
+
+	setGitlabURL(t, server.URL)
+	_, err := LabeledMergeRequests(context.Background(), NewApiClient(), "group/app", "combine")
+	if !IsGraphQLUnsupported(err) {
+		t.Errorf("Expected a schema error to count as unsupported, got %v", err)
+	}
+	if IsGraphQLUnsupported(&GraphQLError{Messages: []string{"Internal server error"}}) || IsGraphQLUnsupported(&APIError{StatusCode: 401}) {
+		t.Error("Expected other errors not to count as unsupported")
+	}
+	if !IsGraphQLUnsupported(&APIError{StatusCode: 404}) {
+		t.Error("Expected a missing GraphQL endpoint to count as unsupported")
+	}
+}
+
+// setGitlabURL points the client at gitlabURL for the duration of the test.
+func setGitlabURL(t *testing.T, gitlabURL string) {
+	previous := config.GitlabURL
+	config.GitlabURL = gitlabURL
+	t.Cleanup(func() { config.GitlabURL = previous })
+}
@@ -0,0 +1,163 @@
+package gitlab
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"gitlab-mr-combiner/internal/config"
+)
+
+// APIError is a 4xx/5xx response of the GitLab API, or of the GitHub API when
+// Forge says so. Message holds the forge's own message/error fields; HTML
+// error pages are not kept.
+type APIError struct {
+	Forge      string
+	StatusCode int
+	Method     string
+	Endpoint   string
+	Message    string
+	RequestID  string
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("%s API %s %s returned %d", e.forgeName(), e.Method, e.Endpoint, e.StatusCode)
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if hint := e.Hint(); hint != "" {
+		msg += " (" + hint + ")"
+	}
+	if e.RequestID != "" {
+		msg += fmt.Sprintf(" [request %s]", e.RequestID)
+	}
+	return msg
+}
+
+// Hint explains what usually causes the status and how to fix it.
+func (e *APIError) Hint() string {
+	switch {
+	case e.StatusCode == http.StatusUnauthorized:
+		return e.tokenVariable() + " is invalid, expired or revoked"
+	case e.StatusCode == http.StatusForbidden && strings.Contains(e.Message, "insufficient_scope"):
+		return "token lacks api scope"
+	case e.StatusCode == http.StatusForbidden:
+		return "the token's user lacks permission for this action"
+	case e.StatusCode == http.StatusNotFound:
+		return "the resource does not exist or the token's user cannot see it"
+	case e.StatusCode == http.StatusConflict:
+		return "the resource was changed concurrently, retry the combine"
+	case e.StatusCode == http.StatusTooManyRequests:
+		return e.forgeName() + " rate limit hit, lower API_RATE_LIMIT"
+	case e.StatusCode >= 500:
+		return e.forgeName() + " is unavailable, retry later"
+	default:
+		return ""
+	}
+}
+
+func (e *APIError) forgeName() string {
+	if e.Forge == config.ForgeGitHub {
+		return "GitHub"
+	}
+	return "GitLab"
+}
+
+func (e *APIError) tokenVariable() string {
+	if e.Forge == config.ForgeGitHub {
+		return "GITHUB_TOKEN"
+	}
+	return "GITLAB_TOKEN"
+}
+
+func newAPIError(forge, method, rawURL string, resp *http.Response, data []byte) *APIError {
+	endpoint := rawURL
+	if parsed, err := url.Parse(rawURL); err == nil {
+		endpoint = strings.TrimPrefix(parsed.EscapedPath(), "/api/v4")
+	}
+
+	return &APIError{
+		Forge:      forge,
+		StatusCode: resp.StatusCode,
+		Method:     method,
+		Endpoint:   endpoint,
+		Message:    errorMessage(data),
+		RequestID:  resp.Header.Get("X-Request-Id"),
+	}
+}
+
+// errorMessage flattens GitLab's error bodies: {"message": "..."},
+// {"message": {"field": ["..."]}}, {"error": "...", "error_description": "..."}.
+func errorMessage(data []byte) string {
+	var body struct {
+		Message          json.RawMessage `json:"message"`
+		Error            string          `json:"error"`
+		ErrorDescription string          `json:"error_description"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return ""
+	}
+
+	var parts []string
+	if len(body.Message) > 0 {
+		parts = append(parts, flattenMessage(body.Message))
+	}
+	if body.Error != "" {
+		parts = append(parts, body.Error)
+	}
+	if body.ErrorDescription != "" {
+		parts = append(parts, body.ErrorDescription)
+	}
+	return strings.Join(parts, ": ")
+}
+
+func flattenMessage(raw json.RawMessage) string {
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return text
+	}
+
+	var list []string
+	if json.Unmarshal(raw, &list) == nil {
+		return strings.Join(list, ", ")
+	}
+
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(raw, &fields) == nil {
+		var parts []string
+		for name, value := range fields {
+			parts = append(parts, name+" "+flattenMessage(value))
+		}
+		sort.Strings(parts)
+		return strings.Join(parts, "; ")
+	}
+	return string(raw)
+}
+
+func statusOf(err error) int {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode
+	}
+	return 0
+}
+
+func IsNotFound(err error) bool {
+	return statusOf(err) == http.StatusNotFound
+}
+
+func IsForbidden(err error) bool {
+	return statusOf(err) == http.StatusForbidden
+}
+
+func IsUnauthorized(err error) bool {
+	return statusOf(err) == http.StatusUnauthorized
+}
+
+func IsConflict(err error) bool {
+	return statusOf(err) == http.StatusConflict
+}
@@ -0,0 +1,209 @@
+package gitlab
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// GraphQLError is a query GitLab rejected or could not resolve, reported in
+// the errors field of an otherwise successful response.
+type GraphQLError struct {
+	Messages []string
+}
+
+func (e *GraphQLError) Error() string {
+	return "GitLab GraphQL query failed: " + strings.Join(e.Messages, "; ")
+}
+
+// IsGraphQLUnsupported reports whether a GraphQL request failed because the
+// GitLab instance has no GraphQL API or its schema lacks fields the query
+// uses, which is the case on older versions.
+func IsGraphQLUnsupported(err error) bool {
+	var graphQLErr *GraphQLError
+	if errors.As(err, &graphQLErr) {
+		for _, message := range graphQLErr.Messages {
+			if strings.Contains(message, "doesn't exist on type") || strings.Contains(message, "doesn't accept argument") {
+				return true
+			}
+		}
+		return false
+	}
+	return IsNotFound(err)
+}
+
+// Query runs a GraphQL query and decodes its data into result. Queries are
+// read-only, so they are retried like GET requests although they are POSTed.
+func (api *ApiClient) Query(ctx context.Context, query string, variables map[string]interface{}, result interface{}) error {
+	request := map[string]interface{}{"query": query, "variables": variables}
+	data, _, err := api.retrying(ctx, http.MethodPost, api.graphQLURL(), request, true)
+	if err != nil {
+		return err
+	}
+
+	var response struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(data, &response); err != nil {
+		return err
+	}
+	if len(response.Errors) > 0 {
+		graphQLErr := &GraphQLError{}
+		for _, e := range response.Errors {
+			graphQLErr.Messages = append(graphQLErr.Messages, e.Message)
+		}
+		return graphQLErr
+	}
+	return json.Unmarshal(response.Data, result)
+}
+
+func (api *ApiClient) graphQLURL() string {
+	return api.webURL() + "/api/graphql"
+}
+
+func (api *ApiClient) webURL() string {
+	return strings.TrimSuffix(api.baseURL, "/api/v4")
+}
+
+const labeledMergeRequestsQuery = `query($fullPath: ID!, $labels: [String!], $after: String) {
+  project(fullPath: $fullPath) {
+    mergeRequests(state: opened, labels: $labels, first: 100, after: $after) {
+      pageInfo { hasNextPage endCursor }
+      nodes {
+        iid title description webUrl draft
+        sourceBranch targetBranch diffHeadSha
+        sourceProjectId targetProjectId
+        author { id username name }
+        labels { nodes { title } }
+        detailedMergeStatus
+        approved approvalsRequired approvalsLeft
+        headPipeline { id status path }
+      }
+    }
+  }
+}`
+
+type graphQLMergeRequest struct {
+	IID                 string `json:"iid"`
+	Title               string `json:"title"`
+	Description         string `json:"description"`
+	WebURL              string `json:"webUrl"`
+	Draft               bool   `json:"draft"`
+	SourceBranch        string `json:"sourceBranch"`
+	TargetBranch        string `json:"targetBranch"`
+	DiffHeadSHA         string `json:"diffHeadSha"`
+	SourceProjectID     int    `json:"sourceProjectId"`
+	TargetProjectID     int    `json:"targetProjectId"`
+	DetailedMergeStatus string `json:"detailedMergeStatus"`
+	Approved            bool   `json:"approved"`
+	ApprovalsRequired   int    `json:"approvalsRequired"`
+	ApprovalsLeft       int    `json:"approvalsLeft"`
+	Author              *struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+		Name     string `json:"name"`
+	} `json:"author"`
+	Labels struct {
+		Nodes []struct {
+			Title string `json:"title"`
+		} `json:"nodes"`
+	} `json:"labels"`
+	HeadPipeline *struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+		Path   string `json:"path"`
+	} `json:"headPipeline"`
+}
+
+// LabeledMergeRequests fetches the open MRs of a project carrying label,
+// including approvals, head pipeline, mergeability and description, in one
+// paginated GraphQL query instead of a REST call per MR.
+func LabeledMergeRequests(ctx context.Context, api *ApiClient, projectPath, label string) ([]MergeRequest, error) {
+	var mergeRequests []MergeRequest
+	after := ""
+	for {
+		var result struct {
+			Project *struct {
+				MergeRequests struct {
+					PageInfo struct {
+						HasNextPage bool   `json:"hasNextPage"`
+						EndCursor   string `json:"endCursor"`
+					} `json:"pageInfo"`
+					Nodes []graphQLMergeRequest `json:"nodes"`
+				} `json:"mergeRequests"`
+			} `json:"project"`
+		}
+		variables := map[string]interface{}{"fullPath": projectPath, "labels": []string{label}}
+		if after != "" {
+			variables["after"] = after
+		}
+		if err := api.Query(ctx, labeledMergeRequestsQuery, variables, &result); err != nil {
+			return nil, err
+		}
+		if result.Project == nil {
+			return nil, fmt.Errorf("project %s not found", projectPath)
+		}
+
+		for _, node := range result.Project.MergeRequests.Nodes {
+			mergeRequests = append(mergeRequests, node.mergeRequest(api))
+		}
+
+		pageInfo := result.Project.MergeRequests.PageInfo
+		if !pageInfo.HasNextPage {
+			return mergeRequests, nil
+		}
+		if pageInfo.EndCursor == "" || pageInfo.EndCursor == after {
+			return nil, fmt.Errorf("pagination of merge requests of %s does not advance", projectPath)
+		}
+		after = pageInfo.EndCursor
+	}
+}
+
+func (node graphQLMergeRequest) mergeRequest(api *ApiClient) MergeRequest {
+	iid, _ := strconv.Atoi(node.IID)
+	mr := MergeRequest{
+		IID:                 iid,
+		Title:               node.Title,
+		Description:         node.Description,
+		SHA:                 node.DiffHeadSHA,
+		WebURL:              node.WebURL,
+		SourceBranch:        node.SourceBranch,
+		TargetBranch:        node.TargetBranch,
+		SourceProjectID:     node.SourceProjectID,
+		TargetProjectID:     node.TargetProjectID,
+		Draft:               node.Draft,
+		DetailedMergeStatus: strings.ToLower(node.DetailedMergeStatus),
+		Approvals: &Approvals{
+			Approved: node.Approved,
+			Required: node.ApprovalsRequired,
+			Left:     node.ApprovalsLeft,
+		},
+	}
+	if node.Author != nil {
+		mr.Author = User{ID: globalIDNumber(node.Author.ID), Username: node.Author.Username, Name: node.Author.Name}
+	}
+	for _, label := range node.Labels.Nodes {
+		mr.Labels = append(mr.Labels, label.Title)
+	}
+	if node.HeadPipeline != nil {
+		mr.HeadPipeline = &Pipeline{
+			ID:     globalIDNumber(node.HeadPipeline.ID),
+			Status: strings.ToLower(node.HeadPipeline.Status),
+			WebURL: api.webURL() + node.HeadPipeline.Path,
+		}
+	}
+	return mr
+}
+
+// globalIDNumber extracts 42 from "gid://gitlab/User/42".
+func globalIDNumber(id string) int {
+	number, _ := strconv.Atoi(id[strings.LastIndex(id, "/")+1:])
+	return number
+}
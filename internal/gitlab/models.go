@@ -1,11 +1,75 @@
 package gitlab
 
+import "gitlab-mr-combiner/internal/config"
+
 type RepoInfo struct {
-	DefaultBranch string `json:"default_branch"`
-	RepoURL       string `json:"ssh_url_to_repo"`
+	ID                int    `json:"id"`
+	PathWithNamespace string `json:"path_with_namespace"`
+	DefaultBranch     string `json:"default_branch"`
+	RepoURL           string `json:"ssh_url_to_repo"`
+	HTTPURL           string `json:"http_url_to_repo"`
+}
+
+// CloneURL returns the remote for GIT_TRANSPORT.
+func (r RepoInfo) CloneURL() string {
+	if config.GitTransport == config.GitTransportHTTPS {
+		return r.HTTPURL
+	}
+	return r.RepoURL
 }
 
 type MergeRequest struct {
-    IID    int    `json:"iid"`
-    Title  string `json:"title"`
-}
\ No newline at end of file
+	IID                 int       `json:"iid"`
+	Title               string    `json:"title"`
+	Description         string    `json:"description"`
+	SHA                 string    `json:"sha"`
+	WebURL              string    `json:"web_url"`
+	SourceBranch        string    `json:"source_branch"`
+	TargetBranch        string    `json:"target_branch"`
+	SourceProjectID     int       `json:"source_project_id"`
+	TargetProjectID     int       `json:"target_project_id"`
+	Author              User      `json:"author"`
+	Labels              []string  `json:"labels"`
+	Draft               bool      `json:"draft"`
+	DetailedMergeStatus string    `json:"detailed_merge_status"`
+	HeadPipeline        *Pipeline `json:"head_pipeline"`
+
+	// Approvals is only known for MRs discovered through GraphQL.
+	Approvals *Approvals `json:"-"`
+}
+
+type Approvals struct {
+	Approved bool
+	Required int
+	Left     int
+}
+
+type User struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	Name     string `json:"name"`
+}
+
+type Pipeline struct {
+	ID     int    `json:"id"`
+	Status string `json:"status"`
+	WebURL string `json:"web_url"`
+}
+
+// Token is the result of /personal_access_tokens/self, which also describes
+// project and group access tokens. ExpiresAt is a date ("2025-01-31") or empty.
+type Token struct {
+	ID        int      `json:"id"`
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	ExpiresAt string   `json:"expires_at"`
+	Active    bool     `json:"active"`
+	Revoked   bool     `json:"revoked"`
+}
+
+type Branch struct {
+	Name   string `json:"name"`
+	Commit struct {
+		ID string `json:"id"`
+	} `json:"commit"`
+}
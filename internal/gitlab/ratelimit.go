@@ -0,0 +1,60 @@
+package gitlab
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter spaces requests interval apart and lets a rate-limited
+// response pause every caller of the client until GitLab accepts requests
+// again. A zero interval only applies the pauses.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(perSecond int) *rateLimiter {
+	limiter := &rateLimiter{}
+	if perSecond > 0 {
+		limiter.interval = time.Second / time.Duration(perSecond)
+	}
+	return limiter
+}
+
+func (l *rateLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	at := l.next
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	return sleep(ctx, time.Until(at))
+}
+
+func (l *rateLimiter) pauseUntil(t time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if t.After(l.next) {
+		l.next = t
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	case <-timer.C:
+		return nil
+	}
+}
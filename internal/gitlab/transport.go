@@ -0,0 +1,91 @@
+package gitlab
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+type Option func(*ApiClient)
+
+func WithTimeout(timeout time.Duration) Option {
+	return func(api *ApiClient) {
+		api.client.Timeout = timeout
+	}
+}
+
+// WithBaseURL points the client at another REST API root, such as the GitHub
+// API, which shares the auth, pagination and retry behaviour of GitLab's.
+func WithBaseURL(baseURL string) Option {
+	return func(api *ApiClient) {
+		api.baseURL = strings.TrimSuffix(baseURL, "/")
+	}
+}
+
+// WithForge names the forge behind baseURL in API errors and their hints.
+func WithForge(forge string) Option {
+	return func(api *ApiClient) {
+		api.forge = forge
+	}
+}
+
+func WithToken(token string) Option {
+	return func(api *ApiClient) {
+		api.token = token
+	}
+}
+
+// WithProxy sends API requests through proxyURL instead of the proxy from
+// HTTPS_PROXY/HTTP_PROXY/NO_PROXY.
+func WithProxy(proxyURL *url.URL) Option {
+	return func(api *ApiClient) {
+		api.transport().Proxy = http.ProxyURL(proxyURL)
+	}
+}
+
+func WithTLSConfig(tlsConfig *tls.Config) Option {
+	return func(api *ApiClient) {
+		api.transport().TLSClientConfig = tlsConfig
+	}
+}
+
+func (api *ApiClient) transport() *http.Transport {
+	return api.client.Transport.(*http.Transport)
+}
+
+// TLSConfig trusts the system roots plus caBundles and, when certFile is
+// set, presents that client certificate for mutual TLS.
+func TLSConfig(caBundles []string, certFile, keyFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if len(caBundles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, bundle := range caBundles {
+			data, err := os.ReadFile(bundle)
+			if err != nil {
+				return nil, fmt.Errorf("error reading CA bundle: %v", err)
+			}
+			if !pool.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("no certificates found in CA bundle %s", bundle)
+			}
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,75 @@
+package lock
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// FileLocker takes an exclusive flock on a file in Dir, which is expected to
+// be a volume shared by all replicas.
+type FileLocker struct {
+	Dir string
+}
+
+type fileLease struct {
+	file *os.File
+}
+
+func (l *FileLocker) Acquire(ctx context.Context, key Key) (Lease, error) {
+	file, err := l.open(key)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		locked, err := tryLockFile(file)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("error locking %s: %v", file.Name(), err)
+		}
+		if locked {
+			return &fileLease{file: file}, nil
+		}
+
+		if err := wait(ctx); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+}
+
+func (l *FileLocker) TryAcquire(ctx context.Context, key Key) (Lease, error) {
+	file, err := l.open(key)
+	if err != nil {
+		return nil, err
+	}
+
+	locked, err := tryLockFile(file)
+	if err != nil || !locked {
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error locking %s: %v", file.Name(), err)
+		}
+		return nil, ErrHeld
+	}
+	return &fileLease{file: file}, nil
+}
+
+func (l *FileLocker) open(key Key) (*os.File, error) {
+	if err := os.MkdirAll(l.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating lock directory: %v", err)
+	}
+
+	file, err := os.OpenFile(filepath.Join(l.Dir, key.String()+".lock"), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening lock file: %v", err)
+	}
+	return file, nil
+}
+
+func (l *fileLease) Release(context.Context) error {
+	defer l.file.Close()
+	return unlockFile(l.file)
+}
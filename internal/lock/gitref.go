@@ -0,0 +1,202 @@
+package lock
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"gitlab-mr-combiner/internal/utils"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const lockRefPrefix = "refs/combiner/locks/"
+
+// GitRefLocker stores a lease as a commit on refs/combiner/locks/<branch> in
+// the project itself. The ref is only ever moved with --force-with-lease, so
+// exactly one replica wins a race; a lease past its expiry can be taken over.
+type GitRefLocker struct {
+	Holder string
+	TTL    time.Duration
+}
+
+type gitRefLease struct {
+	dir     string
+	repoURL string
+	ref     string
+	sha     string
+}
+
+type leaseInfo struct {
+	holder  string
+	expires time.Time
+}
+
+func (l *GitRefLocker) Acquire(ctx context.Context, key Key) (Lease, error) {
+	return l.acquireLease(ctx, key, true)
+}
+
+func (l *GitRefLocker) TryAcquire(ctx context.Context, key Key) (Lease, error) {
+	return l.acquireLease(ctx, key, false)
+}
+
+func (l *GitRefLocker) acquireLease(ctx context.Context, key Key, block bool) (Lease, error) {
+	dir, err := os.MkdirTemp("", "combiner-lock-")
+	if err != nil {
+		return nil, fmt.Errorf("error creating lock workspace: %v", err)
+	}
+
+	lease, err := l.acquire(ctx, dir, key, block)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return lease, nil
+}
+
+func (l *GitRefLocker) acquire(ctx context.Context, dir string, key Key, block bool) (*gitRefLease, error) {
+	if _, err := runGit(ctx, dir, "init", "--bare", "--quiet"); err != nil {
+		return nil, err
+	}
+
+	ref := lockRef(key)
+	for {
+		current, err := remoteRefSHA(ctx, dir, key.RepoURL, ref)
+		if err != nil {
+			return nil, err
+		}
+
+		if current != "" {
+			info, err := readLease(ctx, dir, key.RepoURL, ref)
+			if err != nil {
+				return nil, err
+			}
+			if time.Now().Before(info.expires) {
+				if !block {
+					return nil, ErrHeld
+				}
+				log.Infof("Lock %s is held by %s until %s, waiting", ref, info.holder, info.expires.Format(time.RFC3339))
+				if err := wait(ctx); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			log.Warnf("Lock %s held by %s expired at %s, taking it over", ref, info.holder, info.expires.Format(time.RFC3339))
+		}
+
+		sha, err := l.writeLease(ctx, dir)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = runGit(ctx, dir, "push", "--quiet", "--force-with-lease="+ref+":"+current, key.RepoURL, sha+":"+ref)
+		if err == nil {
+			return &gitRefLease{dir: dir, repoURL: key.RepoURL, ref: ref, sha: sha}, nil
+		}
+		if ctx.Err() != nil {
+			return nil, context.Cause(ctx)
+		}
+
+		if !block {
+			return nil, ErrHeld
+		}
+		log.Infof("Lost the race for %s, retrying: %v", ref, err)
+		if err := wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// lockRef names the ref holding the lease for key; locks of another kind get
+// a namespace of their own next to refs/combiner/locks/. The branch is escaped
+// into a single path component, since refs for "stage" and "stage/x" cannot
+// both exist.
+func lockRef(key Key) string {
+	branch := url.PathEscape(key.Branch)
+	if key.Kind != "" {
+		return "refs/combiner/" + key.Kind + "/" + branch
+	}
+	return lockRefPrefix + branch
+}
+
+func (l *GitRefLocker) writeLease(ctx context.Context, dir string) (string, error) {
+	tree, err := runGit(ctx, dir, "mktree")
+	if err != nil {
+		return "", err
+	}
+
+	message := fmt.Sprintf("combiner lock\n\nholder: %s\nexpires: %s\n", l.Holder, time.Now().Add(l.TTL).UTC().Format(time.RFC3339))
+	return runGit(ctx, dir,
+		"-c", "user.name=gitlab-mr-combiner", "-c", "user.email=combiner@localhost",
+		"commit-tree", tree, "-m", message)
+}
+
+func (l *gitRefLease) Release(ctx context.Context) error {
+	defer os.RemoveAll(l.dir)
+
+	_, err := runGit(ctx, l.dir, "push", "--quiet", "--force-with-lease="+l.ref+":"+l.sha, l.repoURL, ":"+l.ref)
+	return err
+}
+
+func remoteRefSHA(ctx context.Context, dir, repoURL, ref string) (string, error) {
+	output, err := runGit(ctx, dir, "ls-remote", repoURL, ref)
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[1] == ref {
+			return fields[0], nil
+		}
+	}
+	return "", nil
+}
+
+func readLease(ctx context.Context, dir, repoURL, ref string) (leaseInfo, error) {
+	if _, err := runGit(ctx, dir, "fetch", "--quiet", repoURL, ref); err != nil {
+		return leaseInfo{}, err
+	}
+
+	message, err := runGit(ctx, dir, "log", "-1", "--format=%B", "FETCH_HEAD")
+	if err != nil {
+		return leaseInfo{}, err
+	}
+
+	var info leaseInfo
+	scanner := bufio.NewScanner(strings.NewReader(message))
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), ": ")
+		if !ok {
+			continue
+		}
+		switch name {
+		case "holder":
+			info.holder = value
+		case "expires":
+			info.expires, _ = time.Parse(time.RFC3339, value)
+		}
+	}
+	return info, nil
+}
+
+func runGit(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := utils.GitCommandContext(ctx, append([]string{"-C", dir}, args...)...)
+	cmd.Stdin = strings.NewReader("")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", context.Cause(ctx)
+		}
+		return "", fmt.Errorf("git %s: %v, output: %s", args[0], err, stderr.Bytes())
+	}
+	return strings.TrimSpace(string(output)), nil
+}
@@ -0,0 +1,85 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+const pollInterval = 5 * time.Second
+
+// ErrHeld is returned by TryAcquire when someone else holds the lock.
+var ErrHeld = errors.New("lock is held elsewhere")
+
+// Key names a lock. Kind separates locks on the same branch that guard
+// different things; it is empty for the combine lock itself.
+type Key struct {
+	ProjectID int
+	Branch    string
+	RepoURL   string
+	Kind      string
+}
+
+func (k Key) String() string {
+	name := fmt.Sprintf("project-%d-%s", k.ProjectID, url.PathEscape(k.Branch))
+	if k.Kind != "" {
+		// "~" is not allowed in branch names, so a kind never collides
+		// with a branch.
+		name += "~" + k.Kind
+	}
+	return name
+}
+
+// Locker serialises combines of the same project and branch. Acquire blocks
+// until the lock is held or ctx is done; TryAcquire gives up with ErrHeld.
+type Locker interface {
+	Acquire(ctx context.Context, key Key) (Lease, error)
+	TryAcquire(ctx context.Context, key Key) (Lease, error)
+}
+
+type Lease interface {
+	Release(ctx context.Context) error
+}
+
+type noopLease struct{}
+
+func (noopLease) Release(context.Context) error { return nil }
+
+// MemoryLocker relies on the in-process run registry and is only safe with a
+// single replica.
+type MemoryLocker struct{}
+
+func (MemoryLocker) Acquire(context.Context, Key) (Lease, error) {
+	return noopLease{}, nil
+}
+
+func (MemoryLocker) TryAcquire(context.Context, Key) (Lease, error) {
+	return noopLease{}, nil
+}
+
+func wait(ctx context.Context) error {
+	timer := time.NewTimer(pollInterval)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	case <-timer.C:
+		return nil
+	}
+}
+
+func New(backend, dir, holder string, ttl time.Duration) (Locker, error) {
+	switch backend {
+	case "", "memory":
+		return MemoryLocker{}, nil
+	case "file":
+		return &FileLocker{Dir: dir}, nil
+	case "git-ref":
+		return &GitRefLocker{Holder: holder, TTL: ttl}, nil
+	default:
+		return nil, fmt.Errorf("unknown lock backend %q", backend)
+	}
+}
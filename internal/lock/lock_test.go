@@ -0,0 +1,130 @@
+package lock
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileLockerExcludesSecondHolder(t *testing.T) {
+	locker := &FileLocker{Dir: t.TempDir()}
+	key := Key{ProjectID: 1, Branch: "stage"}
+
+	lease, err := locker.Acquire(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Expected the first acquire to succeed, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := locker.Acquire(ctx, key); err == nil {
+		t.Fatalf("Expected the second acquire to block until the deadline")
+	}
+
+	if err := lease.Release(context.Background()); err != nil {
+		t.Fatalf("Expected release to succeed, got %v", err)
+	}
+
+	lease, err = locker.Acquire(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Expected acquire after release to succeed, got %v", err)
+	}
+	lease.Release(context.Background())
+}
+
+func TestFileLockerTryAcquire(t *testing.T) {
+	locker := &FileLocker{Dir: t.TempDir()}
+	key := Key{ProjectID: 1, Branch: "stage"}
+
+	lease, err := locker.TryAcquire(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Expected the first try to succeed, got %v", err)
+	}
+	defer lease.Release(context.Background())
+
+	if _, err := locker.TryAcquire(context.Background(), key); err != ErrHeld {
+		t.Errorf("Expected ErrHeld, got %v", err)
+	}
+
+	other, err := locker.TryAcquire(context.Background(), Key{ProjectID: 1, Branch: "stage", Kind: "schedule"})
+	if err != nil {
+		t.Fatalf("Expected a lock of another kind to be free, got %v", err)
+	}
+	other.Release(context.Background())
+}
+
+func TestGitRefLocker(t *testing.T) {
+	remote := filepath.Join(t.TempDir(), "remote.git")
+	if output, err := exec.Command("git", "init", "--bare", "--quiet", remote).CombinedOutput(); err != nil {
+		t.Skipf("git is not available: %v, %s", err, output)
+	}
+
+	key := Key{ProjectID: 1, Branch: "feature/stage", RepoURL: remote}
+	first := &GitRefLocker{Holder: "replica-a", TTL: time.Hour}
+	second := &GitRefLocker{Holder: "replica-b", TTL: time.Hour}
+
+	lease, err := first.Acquire(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Expected the first acquire to succeed, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if _, err := second.Acquire(ctx, key); err == nil {
+		t.Fatalf("Expected the second replica to wait for the lease")
+	}
+	if _, err := second.TryAcquire(context.Background(), key); err != ErrHeld {
+		t.Errorf("Expected TryAcquire to give up with ErrHeld, got %v", err)
+	}
+
+	if err := lease.Release(context.Background()); err != nil {
+		t.Fatalf("Expected release to succeed, got %v", err)
+	}
+
+	lease, err = second.Acquire(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Expected the second replica to acquire after release, got %v", err)
+	}
+	lease.Release(context.Background())
+}
+
+func TestGitRefLockerNestedBranches(t *testing.T) {
+	remote := filepath.Join(t.TempDir(), "remote.git")
+	if output, err := exec.Command("git", "init", "--bare", "--quiet", remote).CombinedOutput(); err != nil {
+		t.Skipf("git is not available: %v, %s", err, output)
+	}
+
+	locker := &GitRefLocker{Holder: "replica-a", TTL: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	for _, branch := range []string{"stage", "stage/x"} {
+		lease, err := locker.Acquire(ctx, Key{ProjectID: 1, Branch: branch, RepoURL: remote})
+		if err != nil {
+			t.Fatalf("Expected the lock for %s to be acquired, got %v", branch, err)
+		}
+		defer lease.Release(context.Background())
+	}
+}
+
+func TestGitRefLockerTakesOverExpiredLease(t *testing.T) {
+	remote := filepath.Join(t.TempDir(), "remote.git")
+	if output, err := exec.Command("git", "init", "--bare", "--quiet", remote).CombinedOutput(); err != nil {
+		t.Skipf("git is not available: %v, %s", err, output)
+	}
+
+	key := Key{ProjectID: 1, Branch: "stage", RepoURL: remote}
+	if _, err := (&GitRefLocker{Holder: "crashed", TTL: -time.Minute}).Acquire(context.Background(), key); err != nil {
+		t.Fatalf("Expected the first acquire to succeed, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	lease, err := (&GitRefLocker{Holder: "replica-b", TTL: time.Hour}).Acquire(ctx, key)
+	if err != nil {
+		t.Fatalf("Expected the expired lease to be taken over, got %v", err)
+	}
+	lease.Release(context.Background())
+}
@@ -0,0 +1,135 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type collector interface {
+	write(w io.Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []collector
+)
+
+func register(c collector) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, c)
+}
+
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d desc) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, d.kind)
+}
+
+// Vec is a family of values sharing a name and a fixed set of label names.
+type Vec struct {
+	desc
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newVec(kind, name, help string, labels []string) *Vec {
+	v := &Vec{
+		desc:   desc{name: name, help: help, kind: kind, labels: labels},
+		values: map[string]float64{},
+	}
+	register(v)
+	return v
+}
+
+func NewCounterVec(name, help string, labels ...string) *Vec {
+	return newVec("counter", name, help, labels)
+}
+
+func NewGaugeVec(name, help string, labels ...string) *Vec {
+	return newVec("gauge", name, help, labels)
+}
+
+func (v *Vec) key(labelValues []string) string {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.name, len(v.labels), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+func (v *Vec) Add(delta float64, labelValues ...string) {
+	key := v.key(labelValues)
+	v.mu.Lock()
+	v.values[key] += delta
+	v.mu.Unlock()
+}
+
+func (v *Vec) Inc(labelValues ...string) {
+	v.Add(1, labelValues...)
+}
+
+func (v *Vec) Dec(labelValues ...string) {
+	v.Add(-1, labelValues...)
+}
+
+func (v *Vec) Set(value float64, labelValues ...string) {
+	key := v.key(labelValues)
+	v.mu.Lock()
+	v.values[key] = value
+	v.mu.Unlock()
+}
+
+func (v *Vec) Value(labelValues ...string) float64 {
+	key := v.key(labelValues)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.values[key]
+}
+
+func (v *Vec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.writeHeader(w)
+	if len(v.labels) == 0 {
+		fmt.Fprintf(w, "%s %g\n", v.name, v.values[""])
+		return
+	}
+
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		values := strings.Split(key, "\xff")
+		pairs := make([]string, len(v.labels))
+		for i, label := range v.labels {
+			pairs[i] = fmt.Sprintf("%s=%q", label, values[i])
+		}
+		fmt.Fprintf(w, "%s{%s} %g\n", v.name, strings.Join(pairs, ","), v.values[key])
+	}
+}
+
+// Handler serves all registered metrics in the Prometheus text format.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	registryMu.Lock()
+	collectors := append([]collector(nil), registry...)
+	registryMu.Unlock()
+
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
@@ -0,0 +1,67 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	from := time.Date(2026, time.October, 16, 14, 30, 0, 0, time.UTC) // Friday
+
+	testCases := []struct {
+		name     string
+		expr     string
+		expected time.Time
+	}{
+		{"Every Minute", "* * * * *", time.Date(2026, time.October, 16, 14, 31, 0, 0, time.UTC)},
+		{"Nightly Macro", "@nightly", time.Date(2026, time.October, 17, 0, 0, 0, 0, time.UTC)},
+		{"Step Minutes", "*/20 * * * *", time.Date(2026, time.October, 16, 14, 40, 0, 0, time.UTC)},
+		{"Weekdays Only", "0 2 * * mon-fri", time.Date(2026, time.October, 19, 2, 0, 0, 0, time.UTC)},
+		{"Sunday as 7", "0 3 * * 7", time.Date(2026, time.October, 18, 3, 0, 0, 0, time.UTC)},
+		{"Day of Month or Week", "0 0 1 * sat", time.Date(2026, time.October, 17, 0, 0, 0, 0, time.UTC)},
+		{"Month List", "0 0 1 jan,jul *", time.Date(2027, time.January, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			schedule, err := Parse(tc.expr)
+			if err != nil {
+				t.Fatalf("Expected %q to parse, got %v", tc.expr, err)
+			}
+			if next := schedule.Next(from); !next.Equal(tc.expected) {
+				t.Errorf("Expected %s, got %s", tc.expected, next)
+			}
+		})
+	}
+}
+
+func TestParseRejectsInvalidExpressions(t *testing.T) {
+	for _, expr := range []string{"* * * *", "60 * * * *", "* 5-1 * * *", "*/0 * * * *", "* * * foo *"} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Expected %q to be rejected", expr)
+		}
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	window, err := ParseWindow("0 18 * * fri", "62h")
+	if err != nil {
+		t.Fatalf("Expected window to parse, got %v", err)
+	}
+
+	testCases := []struct {
+		at       time.Time
+		expected bool
+	}{
+		{time.Date(2026, time.October, 16, 17, 59, 0, 0, time.UTC), false},
+		{time.Date(2026, time.October, 16, 18, 0, 0, 0, time.UTC), true},
+		{time.Date(2026, time.October, 18, 12, 0, 0, 0, time.UTC), true},
+		{time.Date(2026, time.October, 19, 8, 0, 0, 0, time.UTC), false},
+	}
+
+	for _, tc := range testCases {
+		if got := window.Contains(tc.at); got != tc.expected {
+			t.Errorf("Expected Contains(%s) to be %v, got %v", tc.at, tc.expected, got)
+		}
+	}
+}
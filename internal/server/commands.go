@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab-mr-combiner/internal/config"
+	"gitlab-mr-combiner/internal/metrics"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var commandResults = metrics.NewCounterVec("combiner_commands_total", "Executed note commands by name and result", "command", "result")
+
+const (
+	commandStatus  = "status"
+	commandList    = "list"
+	commandExclude = "exclude"
+	commandInclude = "include"
+	commandCancel  = "cancel"
+)
+
+// noteCommand is a "/combine <name> [!iid] [profile]" note. Unknown names
+// are kept so that the reply can explain the usage.
+type noteCommand struct {
+	name            string
+	mergeRequestIID int
+	profile         string
+}
+
+func parseCommand(note string) (noteCommand, bool) {
+	fields := strings.Fields(note)
+	if len(fields) < 2 || fields[0] != config.CommandPrefix {
+		return noteCommand{}, false
+	}
+
+	command := noteCommand{name: strings.ToLower(fields[1])}
+	for _, arg := range fields[2:] {
+		if iid, err := strconv.Atoi(strings.TrimPrefix(arg, "!")); err == nil && command.mergeRequestIID == 0 {
+			command.mergeRequestIID = iid
+			continue
+		}
+		command.profile = arg
+	}
+	return command, true
+}
+
+func commandUsage() string {
+	return strings.Join([]string{
+		config.CommandPrefix + " status [profile]",
+		config.CommandPrefix + " list [profile]",
+		config.CommandPrefix + " exclude !<iid> [profile]",
+		config.CommandPrefix + " include !<iid> [profile]",
+		config.CommandPrefix + " cancel [profile]",
+	}, "\n")
+}
+
+// runCommand executes a note command and replies on the MR it was posted on.
+func (s *Server) runCommand(trigger combineTrigger) {
+	defer s.recoverCommand(trigger)
+
+	command := trigger.command
+	ctx, cancel := context.WithTimeout(context.Background(), config.StepTimeout)
+	defer cancel()
+
+	logger := log.WithFields(log.Fields{"project": trigger.projectID, "mr": trigger.mergeRequestIID, "command": command.name})
+	reply, err := s.executeCommand(ctx, trigger.projectID, *command, trigger.profiles)
+	if err != nil {
+		logger.Errorf("Command failed: %v", err)
+		reply = fmt.Sprintf("Error: %v", err)
+		commandResults.Inc(command.name, "failed")
+	} else {
+		logger.Info("Command executed")
+		commandResults.Inc(command.name, "succeeded")
+	}
+
+	header := fmt.Sprintf("Result of %s %s", config.CommandPrefix, command.name)
+	if err := s.createCommentOnMR(ctx, trigger.projectID, trigger.mergeRequestIID, reply, header); err != nil {
+		logger.Errorf("Failed to reply to command: %v", err)
+	}
+}
+
+// recoverCommand keeps a panicking command from taking the whole server down,
+// like recoverJob does for combine runs.
+func (s *Server) recoverCommand(trigger combineTrigger) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+
+	logger := log.WithFields(log.Fields{"project": trigger.projectID, "mr": trigger.mergeRequestIID, "command": trigger.command.name})
+	logger.Errorf("Command panicked: %v\n%s", recovered, debug.Stack())
+	commandResults.Inc(trigger.command.name, "panicked")
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.StepTimeout)
+	defer cancel()
+	header := fmt.Sprintf("Result of %s %s", config.CommandPrefix, trigger.command.name)
+	if err := s.createCommentOnMR(ctx, trigger.projectID, trigger.mergeRequestIID, "Internal error, see the combiner logs", header); err != nil {
+		logger.Errorf("Failed to reply to command: %v", err)
+	}
+}
+
+func (s *Server) executeCommand(ctx context.Context, projectID int, command noteCommand, profiles []config.Profile) (string, error) {
+	profiles, err := selectProfiles(command.profile, profiles)
+	if err != nil {
+		return "", err
+	}
+
+	var lines []string
+	switch command.name {
+	case commandStatus:
+		for _, profile := range profiles {
+			lines = append(lines, s.profileStatus(runKey{projectID: projectID, targetBranch: profile.TargetBranch}, profile))
+		}
+	case commandList:
+		for _, profile := range profiles {
+			mergeRequests, err := s.fetchMergeRequests(ctx, projectID, profile.Label)
+			if err != nil {
+				return "", fmt.Errorf("error fetching merge requests for %s: %w", profile.Name, err)
+			}
+			if len(mergeRequests) == 0 {
+				lines = append(lines, fmt.Sprintf("%s: no open merge requests carry %s", profile.Name, profile.Label))
+				continue
+			}
+			for _, mr := range mergeRequests {
+				lines = append(lines, fmt.Sprintf("%s: !%d %s by @%s (%s)", profile.Name, mr.IID, mr.Title, mr.Author.Username, shortSHA(mr.SHA)))
+			}
+		}
+	case commandExclude, commandInclude:
+		if command.mergeRequestIID == 0 {
+			return "", fmt.Errorf("missing merge request, usage:\n%s", commandUsage())
+		}
+		if len(profiles) > 1 {
+			return "", fmt.Errorf("more than one profile is configured, name one of: %s", profileNames(profiles))
+		}
+		if err := s.updateMergeRequestLabel(ctx, projectID, command.mergeRequestIID, profiles[0].Label, command.name == commandInclude); err != nil {
+			return "", fmt.Errorf("error updating labels of !%d: %w", command.mergeRequestIID, err)
+		}
+		if command.name == commandInclude {
+			lines = append(lines, fmt.Sprintf("Added %s to !%d", profiles[0].Label, command.mergeRequestIID))
+		} else {
+			lines = append(lines, fmt.Sprintf("Removed %s from !%d", profiles[0].Label, command.mergeRequestIID))
+		}
+	case commandCancel:
+		for _, profile := range profiles {
+			key := runKey{projectID: projectID, targetBranch: profile.TargetBranch}
+			value, ok := s.activeProjects.Load(key)
+			if !ok {
+				lines = append(lines, fmt.Sprintf("%s: no run in progress", profile.Name))
+				continue
+			}
+			job := value.(*combineJob)
+			job.cancel(errCancelled)
+			lines = append(lines, fmt.Sprintf("%s: cancelling run %s", profile.Name, job.id))
+		}
+	default:
+		return "", fmt.Errorf("unknown command %q, usage:\n%s", command.name, commandUsage())
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+func (s *Server) profileStatus(key runKey, profile config.Profile) string {
+	status := fmt.Sprintf("%s: no run in progress", profile.Name)
+	if value, ok := s.activeProjects.Load(key); ok {
+		job := value.(*combineJob)
+		status = fmt.Sprintf("%s: run %s is %s", profile.Name, job.id, job.State())
+	}
+
+	if value, ok := s.lastRuns.Load(key); ok {
+		job := value.(*combineJob)
+		job.mu.Lock()
+		state, finishedAt := job.state, job.finishedAt
+		job.mu.Unlock()
+		status += fmt.Sprintf(", last run %s %s at %s", job.id, state, finishedAt.UTC().Format(time.RFC3339))
+	}
+	return status
+}
+
+func selectProfiles(name string, profiles []config.Profile) ([]config.Profile, error) {
+	if name == "" {
+		return profiles, nil
+	}
+	for _, profile := range profiles {
+		if profile.Name == name || profile.TargetBranch == name {
+			return []config.Profile{profile}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown profile %q, configured profiles: %s", name, profileNames(profiles))
+}
+
+func profileNames(profiles []config.Profile) string {
+	names := make([]string, 0, len(profiles))
+	for _, profile := range profiles {
+		names = append(names, profile.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+func (s *Server) updateMergeRequestLabel(ctx context.Context, projectID, mergeRequestIID int, label string, add bool) error {
+	field := "remove_labels"
+	if add {
+		field = "add_labels"
+	}
+
+	_, err := s.apiClient.Send(ctx, "PUT", fmt.Sprintf("/projects/%d/merge_requests/%d", projectID, mergeRequestIID), map[string]string{field: label})
+	return err
+}
@@ -1,37 +1,60 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"gitlab-mr-combiner/internal/config"
-	"net/http"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
 
-func (s *Server) addCommentToBuffer(mergeRequestID int, comment string) {
-	comments, _ := s.commentsBuffer.LoadOrStore(mergeRequestID, []string{})
-	comments = append(comments.([]string), comment)
-	s.commentsBuffer.Store(mergeRequestID, comments)
+func (s *Server) addCommentToBuffer(job *combineJob, comment string) {
+	job.comments = append(job.comments, comment)
 	log.Info(comment)
 }
 
-func (s *Server) sendComments(projectID, mergeRequestID int, hasError bool, r *http.Request) {
-	comments, ok := s.commentsBuffer.Load(mergeRequestID)
-	if !ok {
-		log.Warnf("No comments found for MR #%d", mergeRequestID)
+func (s *Server) sendComments(job *combineJob, hasError bool) {
+	s.postJobReport(job, s.getStatusMessage(hasError, job.targetBranch))
+}
+
+func (s *Server) notifySuperseded(job *combineJob) {
+	log.Infof("Run for %s was superseded, nothing was pushed", job.key())
+	s.addCommentToBuffer(job, "Cancelled: a newer trigger arrived, the combine restarts with the current set of MRs")
+	s.postJobReport(job, fmt.Sprintf("Combine into %s was superseded by a newer trigger", job.targetBranch))
+}
+
+func (s *Server) notifyCancelled(job *combineJob) {
+	log.Infof("Run for %s was cancelled, nothing was pushed", job.key())
+	s.addCommentToBuffer(job, "Cancelled on request, nothing was pushed")
+	s.postJobReport(job, fmt.Sprintf("Combine into %s was cancelled", job.targetBranch))
+}
+
+func (s *Server) notifyInternalError(job *combineJob) {
+	job.comments = []string{fmt.Sprintf("Internal error, see the combiner logs for run %s", job.id)}
+	s.postJobReport(job, fmt.Sprintf("Combine into %s failed with an internal error", job.targetBranch))
+}
+
+func (s *Server) postJobReport(job *combineJob, message string) {
+	if len(job.comments) == 0 {
+		log.Warnf("No comments found for MR #%d", job.mergeRequestIID)
+		return
+	}
+
+	if job.mergeRequestIID == 0 {
+		log.WithField("run_id", job.id).Infof("%s:\n%s", message, s.formatComments(job.comments))
+		job.comments = nil
 		return
 	}
 
-	targetBranch := s.GetQueryParam("branch", config.TargetBranch, r)
-	combinedComment := s.formatComments(comments.([]string))
-	message := s.getStatusMessage(hasError, targetBranch)
+	ctx, cancel := context.WithTimeout(context.Background(), config.StepTimeout)
+	defer cancel()
 
-	if err := s.createCommentOnMR(projectID, mergeRequestID, combinedComment, message); err != nil {
+	if err := s.createCommentOnMR(ctx, job.projectID, job.mergeRequestIID, s.formatComments(job.comments), fmt.Sprintf("%s (run %s)", message, job.id)); err != nil {
 		log.Errorf("Failed to add comment: %v", err)
 	}
 
-	s.commentsBuffer.Delete(mergeRequestID)
+	job.comments = nil
 }
 
 func (s *Server) formatComments(comments []string) string {
@@ -45,20 +68,14 @@ func (s *Server) getStatusMessage(hasError bool, targetBranch string) string {
 	return "Merge Requests were merged into " + targetBranch
 }
 
-func (s *Server) createCommentOnMR(projectID, mergeRequestID int, comment string, beforeCommentMessage string) error {
+func (s *Server) createCommentOnMR(ctx context.Context, projectID, mergeRequestID int, comment string, beforeCommentMessage string) error {
 	formattedComment := fmt.Sprintf("%s\n```\n%s\n```", beforeCommentMessage, comment)
 
-	_, err := s.apiClient.Send(
-		"POST", 
-		fmt.Sprintf("/projects/%d/merge_requests/%d/notes", projectID, mergeRequestID), 
-		map[string]string{"body": formattedComment},
-	)
-	
-	if err != nil {
+	if err := s.forge.comment(ctx, projectID, mergeRequestID, formattedComment); err != nil {
 		log.Errorf("Failed to add comment: %v", err)
 		return err
 	}
-	
+
 	log.Infof("Comment added to MR #%d", mergeRequestID)
 	return nil
-}
\ No newline at end of file
+}
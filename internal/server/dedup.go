@@ -0,0 +1,105 @@
+package server
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+
+	"gitlab-mr-combiner/internal/metrics"
+)
+
+var duplicateEvents = metrics.NewCounterVec("combiner_duplicate_events_total", "Webhook deliveries acknowledged as duplicates")
+
+var eventIDHeaders = []string{"X-Gitlab-Event-UUID", "X-GitHub-Delivery", "Idempotency-Key"}
+
+// eventCache remembers recently seen delivery IDs for a fixed TTL. Entries
+// share one TTL, so insertion order is also expiry order and the oldest entry
+// is the one evicted when the cache is full.
+type eventCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	max     int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type eventCacheEntry struct {
+	key     string
+	expires time.Time
+}
+
+func newEventCache(ttl time.Duration, max int) *eventCache {
+	return &eventCache{
+		ttl:     ttl,
+		max:     max,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+// add records keys and reports false if any of them was already seen.
+func (c *eventCache) add(keys []string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.evictExpired(now)
+	for _, key := range keys {
+		if _, ok := c.entries[key]; ok {
+			return false
+		}
+	}
+
+	for _, key := range keys {
+		c.entries[key] = c.order.PushBack(&eventCacheEntry{key: key, expires: now.Add(c.ttl)})
+		for c.max > 0 && c.order.Len() > c.max {
+			c.removeElement(c.order.Front())
+		}
+	}
+	return true
+}
+
+func (c *eventCache) remove(keys []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, key := range keys {
+		if element, ok := c.entries[key]; ok {
+			c.removeElement(element)
+		}
+	}
+}
+
+func (c *eventCache) evictExpired(now time.Time) {
+	for element := c.order.Front(); element != nil; element = c.order.Front() {
+		if element.Value.(*eventCacheEntry).expires.After(now) {
+			return
+		}
+		c.removeElement(element)
+	}
+}
+
+func (c *eventCache) removeElement(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*eventCacheEntry).key)
+}
+
+func eventIDs(r *http.Request) []string {
+	var keys []string
+	for _, header := range eventIDHeaders {
+		if value := r.Header.Get(header); value != "" {
+			keys = append(keys, header+":"+value)
+		}
+	}
+	return keys
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"gitlab-mr-combiner/internal/metrics"
+)
+
+const (
+	eventTypeNote         = "note"
+	eventTypeMergeRequest = "merge_request"
+	eventTypePush         = "push"
+
+	maxEventKindLength = 64
+)
+
+var unknownEvents = metrics.NewCounterVec("combiner_unknown_events_total", "Webhook events without a registered handler", "kind")
+
+// knownEventKinds are the GitLab and GitHub event kinds counted under their
+// own name in combiner_unknown_events_total. Anything else is counted as
+// "other": the kind comes from unauthenticated requests and must not create
+// unbounded metric series.
+var knownEventKinds = map[string]bool{
+	"issue": true, "work_item": true, "pipeline": true, "build": true, "job": true, "tag_push": true,
+	"wiki_page": true, "deployment": true, "release": true, "feature_flag": true, "emoji": true,
+	"ping": true, "issues": true, "issue_comment": true, "pull_request_review": true,
+	"pull_request_review_comment": true, "check_run": true, "check_suite": true, "status": true,
+	"workflow_run": true, "create": true, "delete": true,
+}
+
+func metricKind(kind string) string {
+	if knownEventKinds[kind] {
+		return kind
+	}
+	return "other"
+}
+
+type EventProject struct {
+	ID                int    `json:"id"`
+	PathWithNamespace string `json:"path_with_namespace"`
+	DefaultBranch     string `json:"default_branch"`
+}
+
+type EventUser struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+}
+
+// eventHandler decodes one kind of webhook payload and decides whether it
+// triggers a combine. An error means the payload could not be decoded.
+type eventHandler func(s *Server, body []byte) (combineTrigger, bool, error)
+
+var eventHandlers = map[string]eventHandler{
+	eventTypeNote:         typedHandler((*Server).validateNoteEvent),
+	eventTypeMergeRequest: typedHandler((*Server).validateMergeRequestEvent),
+	eventTypePush:         typedHandler((*Server).validatePushEvent),
+}
+
+// eventHeaders maps X-Gitlab-Event values to handler kinds.
+var eventHeaders = map[string]string{
+	"Note Hook":          eventTypeNote,
+	"Merge Request Hook": eventTypeMergeRequest,
+	"Push Hook":          eventTypePush,
+}
+
+func typedHandler[T any](validate func(*Server, T) (combineTrigger, bool)) eventHandler {
+	return func(s *Server, body []byte) (combineTrigger, bool, error) {
+		var payload T
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return combineTrigger{}, false, err
+		}
+		trigger, ok := validate(s, payload)
+		return trigger, ok, nil
+	}
+}
+
+// eventKind routes by the X-Gitlab-Event header and falls back to the
+// object_kind/event_type/event_name fields of the payload, which is also how
+// system hooks ("System Hook" header) are told apart. An empty kind means the
+// body is not a GitLab event at all.
+func eventKind(r *http.Request, body []byte) string {
+	header := r.Header.Get("X-Gitlab-Event")
+	if kind, ok := eventHeaders[header]; ok {
+		return kind
+	}
+
+	var envelope struct {
+		ObjectKind string `json:"object_kind"`
+		EventType  string `json:"event_type"`
+		EventName  string `json:"event_name"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return ""
+	}
+
+	kind := envelope.ObjectKind
+	if kind == "" {
+		kind = envelope.EventType
+	}
+	if kind == "" {
+		kind = envelope.EventName
+	}
+	if kind == "" {
+		kind = header
+	}
+	if len(kind) > maxEventKindLength {
+		kind = kind[:maxEventKindLength]
+	}
+	return kind
+}
+
+func (s *Server) validateEvent(kind string, body []byte) (combineTrigger, bool, error) {
+	handler, ok := eventHandlers[kind]
+	if !ok {
+		return combineTrigger{}, false, nil
+	}
+	return handler(s, body)
+}
@@ -0,0 +1,321 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gitlab-mr-combiner/internal/config"
+	"gitlab-mr-combiner/internal/gitlab"
+)
+
+type GitHubRepository struct {
+	ID            int    `json:"id"`
+	FullName      string `json:"full_name"`
+	DefaultBranch string `json:"default_branch"`
+	SSHURL        string `json:"ssh_url"`
+	CloneURL      string `json:"clone_url"`
+}
+
+type GitHubUser struct {
+	ID    int    `json:"id"`
+	Login string `json:"login"`
+}
+
+type GitHubLabel struct {
+	Name string `json:"name"`
+}
+
+// GitHubBranch is the head or base of a pull request. Repo is null when the
+// fork the head lives in was deleted.
+type GitHubBranch struct {
+	Ref  string            `json:"ref"`
+	SHA  string            `json:"sha"`
+	Repo *GitHubRepository `json:"repo"`
+}
+
+type GitHubPullRequest struct {
+	Number         int           `json:"number"`
+	Title          string        `json:"title"`
+	Body           string        `json:"body"`
+	HTMLURL        string        `json:"html_url"`
+	Draft          bool          `json:"draft"`
+	Merged         bool          `json:"merged"`
+	MergeableState string        `json:"mergeable_state"`
+	User           GitHubUser    `json:"user"`
+	Labels         []GitHubLabel `json:"labels"`
+	Head           GitHubBranch  `json:"head"`
+	Base           GitHubBranch  `json:"base"`
+}
+
+type GitHubPullRequestEvent struct {
+	Action      string            `json:"action"`
+	Before      string            `json:"before"`
+	PullRequest GitHubPullRequest `json:"pull_request"`
+	Label       *GitHubLabel      `json:"label"`
+	Repository  GitHubRepository  `json:"repository"`
+}
+
+type GitHubPushEvent struct {
+	Ref        string           `json:"ref"`
+	After      string           `json:"after"`
+	Repository GitHubRepository `json:"repository"`
+	Pusher     struct {
+		Name string `json:"name"`
+	} `json:"pusher"`
+}
+
+// githubEventHandlers map X-GitHub-Event values to handlers. The payloads are
+// translated into their GitLab counterparts so that both forges share the
+// trigger rules.
+var githubEventHandlers = map[string]eventHandler{
+	"pull_request": typedHandler((*Server).validateGitHubPullRequestEvent),
+	"push":         typedHandler((*Server).validateGitHubPushEvent),
+}
+
+func (s *Server) validateGitHubPullRequestEvent(event GitHubPullRequestEvent) (combineTrigger, bool) {
+	pr := event.PullRequest
+	attr := MREventAttr{
+		IID:             pr.Number,
+		TargetProjectID: event.Repository.ID,
+		Labels:          githubLabels(pr.Labels),
+	}
+	var changes MREventChanges
+
+	switch event.Action {
+	case "opened":
+		attr.Action = actionOpen
+	case "reopened":
+		attr.Action = actionReopen
+	case "closed":
+		attr.Action = actionClose
+		if pr.Merged {
+			attr.Action = actionMerge
+		}
+	case "labeled", "unlabeled":
+		// pull_request.labels already reflects the change.
+		attr.Action = actionUpdate
+		previous := attr.Labels
+		if event.Label != nil {
+			previous = previousLabels(attr.Labels, event.Label.Name, event.Action == "labeled")
+		}
+		changes.Labels = &struct {
+			Previous []EventLabel `json:"previous"`
+			Current  []EventLabel `json:"current"`
+		}{Previous: previous, Current: attr.Labels}
+	case "synchronize":
+		attr.Action = actionUpdate
+		attr.OldRev = event.Before
+	default:
+		attr.Action = event.Action
+	}
+
+	return s.validateMergeRequestEvent(MergeRequestEvent{
+		Project:          githubProject(event.Repository),
+		ObjectAttributes: attr,
+		Changes:          changes,
+	})
+}
+
+func (s *Server) validateGitHubPushEvent(event GitHubPushEvent) (combineTrigger, bool) {
+	return s.validatePushEvent(PushEvent{
+		ProjectID:    event.Repository.ID,
+		Ref:          event.Ref,
+		After:        event.After,
+		UserUsername: event.Pusher.Name,
+		Project:      githubProject(event.Repository),
+	})
+}
+
+func githubProject(repo GitHubRepository) EventProject {
+	return EventProject{ID: repo.ID, PathWithNamespace: repo.FullName, DefaultBranch: repo.DefaultBranch}
+}
+
+func githubLabels(labels []GitHubLabel) []EventLabel {
+	result := make([]EventLabel, 0, len(labels))
+	for _, label := range labels {
+		result = append(result, EventLabel{Title: label.Name})
+	}
+	return result
+}
+
+func previousLabels(current []EventLabel, name string, added bool) []EventLabel {
+	var previous []EventLabel
+	for _, label := range current {
+		if label.Title != name {
+			previous = append(previous, label)
+		}
+	}
+	if !added {
+		previous = append(previous, EventLabel{Title: name})
+	}
+	return previous
+}
+
+// githubProvider combines pull requests labeled like GitLab merge requests.
+// Projects are addressed by repository ID through the /repositories/<id>
+// routes of the GitHub API, so job and lock keys stay numeric.
+type githubProvider struct {
+	s   *Server
+	api *gitlab.ApiClient
+}
+
+// newGitHubProvider takes the transport options of the GitLab client, so the
+// proxy, CA bundle and timeout settings apply to GitHub as well.
+func newGitHubProvider(s *Server, options ...gitlab.Option) githubProvider {
+	options = append(options, gitlab.WithBaseURL(config.GithubAPIURL), gitlab.WithToken(config.GithubToken), gitlab.WithForge(config.ForgeGitHub))
+	return githubProvider{s: s, api: gitlab.NewApiClient(options...)}
+}
+
+func (p githubProvider) parseWebhook(r *http.Request, body []byte) (combineTrigger, bool, error) {
+	kind := r.Header.Get("X-GitHub-Event")
+	if kind == "" {
+		return combineTrigger{}, false, errInvalidBody
+	}
+	handler, ok := githubEventHandlers[kind]
+	if !ok {
+		if len(kind) > maxEventKindLength {
+			kind = kind[:maxEventKindLength]
+		}
+		return combineTrigger{}, false, &unsupportedEventError{kind: kind}
+	}
+
+	trigger, ok, err := handler(p.s, body)
+	if err != nil {
+		return combineTrigger{}, false, errInvalidBody
+	}
+	return trigger, ok, nil
+}
+
+// verifyWebhook checks the X-Hub-Signature-256 HMAC that GitHub computes over
+// the body with SECRET_TOKEN.
+func (p githubProvider) verifyWebhook(r *http.Request, body []byte, projectID int) error {
+	if config.SecretToken == "" {
+		return nil
+	}
+
+	signature, ok := strings.CutPrefix(r.Header.Get("X-Hub-Signature-256"), "sha256=")
+	expected, err := hex.DecodeString(signature)
+	if !ok || err != nil {
+		return fmt.Errorf("missing webhook signature for project %d", projectID)
+	}
+
+	mac := hmac.New(sha256.New, []byte(config.SecretToken))
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return fmt.Errorf("invalid webhook signature for project %d", projectID)
+	}
+	return nil
+}
+
+func (p githubProvider) repoInfo(ctx context.Context, projectID int) (*gitlab.RepoInfo, error) {
+	data, err := p.api.Send(ctx, "GET", fmt.Sprintf("/repositories/%d", projectID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var repo GitHubRepository
+	if err := json.Unmarshal(data, &repo); err != nil {
+		return nil, err
+	}
+	return &gitlab.RepoInfo{
+		ID:                repo.ID,
+		PathWithNamespace: repo.FullName,
+		DefaultBranch:     repo.DefaultBranch,
+		RepoURL:           repo.SSHURL,
+		HTTPURL:           repo.CloneURL,
+	}, nil
+}
+
+// labeledChanges lists the open pull requests and keeps the labeled ones: the
+// pulls endpoint cannot filter by label, and the issues endpoint that can
+// lacks the head commit.
+func (p githubProvider) labeledChanges(ctx context.Context, projectID int, _, label string) ([]gitlab.MergeRequest, error) {
+	pulls, err := gitlab.List[GitHubPullRequest](ctx, p.api, fmt.Sprintf("/repositories/%d/pulls?state=open", projectID))
+	if err != nil {
+		return nil, err
+	}
+
+	var mergeRequests []gitlab.MergeRequest
+	for _, pr := range pulls {
+		if hasLabel(githubLabels(pr.Labels), label) {
+			mergeRequests = append(mergeRequests, pr.mergeRequest())
+		}
+	}
+	return mergeRequests, nil
+}
+
+func (p githubProvider) branchSHA(ctx context.Context, projectID int, branch string) (string, error) {
+	data, err := p.api.Send(ctx, "GET", fmt.Sprintf("/repositories/%d/branches/%s", projectID, url.PathEscape(branch)), nil)
+	if err != nil {
+		return "", err
+	}
+
+	var result struct {
+		Commit struct {
+			SHA string `json:"sha"`
+		} `json:"commit"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return "", err
+	}
+	return result.Commit.SHA, nil
+}
+
+func (p githubProvider) change(ctx context.Context, projectID, number int) (*gitlab.MergeRequest, error) {
+	data, err := p.api.Send(ctx, "GET", fmt.Sprintf("/repositories/%d/pulls/%d", projectID, number), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var pr GitHubPullRequest
+	if err := json.Unmarshal(data, &pr); err != nil {
+		return nil, err
+	}
+	mergeRequest := pr.mergeRequest()
+	return &mergeRequest, nil
+}
+
+func (p githubProvider) comment(ctx context.Context, projectID, number int, body string) error {
+	_, err := p.api.Send(ctx, "POST", fmt.Sprintf("/repositories/%d/issues/%d/comments", projectID, number), map[string]string{"body": body})
+	return err
+}
+
+func (p githubProvider) headRef(number int) string {
+	return fmt.Sprintf("pull/%d/head", number)
+}
+
+func (p githubProvider) reference(number int) string {
+	return fmt.Sprintf("#%d", number)
+}
+
+func (pr GitHubPullRequest) mergeRequest() gitlab.MergeRequest {
+	mr := gitlab.MergeRequest{
+		IID:                 pr.Number,
+		Title:               pr.Title,
+		Description:         pr.Body,
+		SHA:                 pr.Head.SHA,
+		WebURL:              pr.HTMLURL,
+		SourceBranch:        pr.Head.Ref,
+		TargetBranch:        pr.Base.Ref,
+		Author:              gitlab.User{ID: pr.User.ID, Username: pr.User.Login},
+		Draft:               pr.Draft,
+		DetailedMergeStatus: pr.MergeableState,
+	}
+	if pr.Head.Repo != nil {
+		mr.SourceProjectID = pr.Head.Repo.ID
+	}
+	if pr.Base.Repo != nil {
+		mr.TargetProjectID = pr.Base.Repo.ID
+	}
+	for _, label := range pr.Labels {
+		mr.Labels = append(mr.Labels, label.Name)
+	}
+	return mr
+}
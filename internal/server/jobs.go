@@ -0,0 +1,298 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab-mr-combiner/internal/config"
+	"gitlab-mr-combiner/internal/metrics"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	errSuperseded = errors.New("superseded by a newer trigger")
+	errCancelled  = errors.New("cancelled on request")
+	errUnchanged  = errors.New("nothing changed since the last push")
+	errRunning    = errors.New("a run is already queued or in flight")
+	errScheduled  = errors.New("another replica runs this schedule")
+	errNoBranch   = errors.New("no labeled MRs and no combined branch to update")
+)
+
+type runKey struct {
+	projectID    int
+	targetBranch string
+}
+
+func (k runKey) String() string {
+	return fmt.Sprintf("project %d, branch %s", k.projectID, k.targetBranch)
+}
+
+// combineTrigger is an accepted webhook event: the profiles whose combined
+// branch has to be rebuilt for a project, reported on mergeRequestIID.
+type combineTrigger struct {
+	projectID       int
+	projectPath     string
+	mergeRequestIID int
+	namespace       string
+	action          string
+	profiles        []config.Profile
+	refresh         map[string]bool
+	command         *noteCommand
+	fromNote        bool
+	user            EventUser
+}
+
+// refreshes reports whether the rebuild of profile is debounced rather than
+// queued right away, keyed by profile name since one event can be a label
+// change for one profile and a source push for another.
+func (t combineTrigger) refreshes(profile config.Profile) bool {
+	return t.refresh[profile.Name]
+}
+
+type jobState string
+
+const (
+	jobQueued     jobState = "queued"
+	jobRunning    jobState = "running"
+	jobSucceeded  jobState = "succeeded"
+	jobFailed     jobState = "failed"
+	jobSuperseded jobState = "superseded"
+	jobSkipped    jobState = "skipped"
+	jobCancelled  jobState = "cancelled"
+)
+
+var jobResults = metrics.NewCounterVec("combiner_jobs_total", "Finished combine jobs by result", "result")
+
+type combineJob struct {
+	id              string
+	projectID       int
+	mergeRequestIID int
+	profile         config.Profile
+	targetBranch    string
+	namespace       string
+	skipUnchanged   bool
+	refresh         bool
+
+	ctx      context.Context
+	cancel   context.CancelCauseFunc
+	done     chan struct{}
+	previous *combineJob
+	comments []string
+
+	mu         sync.Mutex
+	state      jobState
+	finishedAt time.Time
+}
+
+func newCombineJob(projectID, mergeRequestIID int, profile config.Profile) *combineJob {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	return &combineJob{
+		id:              newRunID(),
+		state:           jobQueued,
+		projectID:       projectID,
+		mergeRequestIID: mergeRequestIID,
+		profile:         profile,
+		targetBranch:    profile.TargetBranch,
+		ctx:             ctx,
+		cancel:          cancel,
+		done:            make(chan struct{}),
+	}
+}
+
+func newRunID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+func (j *combineJob) State() jobState {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.state
+}
+
+func (j *combineJob) setState(state jobState) {
+	finished := state != jobQueued && state != jobRunning
+
+	j.mu.Lock()
+	j.state = state
+	if finished {
+		j.finishedAt = time.Now()
+	}
+	j.mu.Unlock()
+
+	if finished {
+		jobResults.Inc(string(state))
+	}
+}
+
+func (j *combineJob) key() runKey {
+	return runKey{projectID: j.projectID, targetBranch: j.targetBranch}
+}
+
+// namespaceOf returns the group part of a project path, which is the unit
+// used for per-namespace fairness in the worker pool.
+func namespaceOf(projectID int, pathWithNamespace string) string {
+	if i := strings.LastIndex(pathWithNamespace, "/"); i > 0 {
+		return pathWithNamespace[:i]
+	}
+	return fmt.Sprintf("project-%d", projectID)
+}
+
+func (j *combineJob) superseded() bool {
+	return errors.Is(context.Cause(j.ctx), errSuperseded)
+}
+
+func (j *combineJob) cancelled() bool {
+	return errors.Is(context.Cause(j.ctx), errCancelled)
+}
+
+// interrupted reports whether the run was stopped before it could push,
+// either by a newer trigger or by /combine cancel.
+func (j *combineJob) interrupted() bool {
+	return j.superseded() || j.cancelled()
+}
+
+// startMergeProcess applies the "latest wins" policy: a run already queued or
+// in flight for the same project and branch is cancelled, and the new run
+// starts only once the old one has released the clone directory. Scheduled
+// runs are the exception: they yield to any run already there, which builds
+// from the same inputs anyway, and errRunning reports that they were dropped.
+// Either all jobs that do not yield are queued or none of them.
+func (s *Server) startMergeProcess(jobs ...*combineJob) error {
+	yielded := false
+	err := s.pool.submit(jobs, func(job *combineJob) bool {
+		key := job.key()
+		value, loaded := s.activeProjects.Load(key)
+		if loaded && job.skipUnchanged {
+			yielded = true
+			return false
+		}
+
+		s.activeProjects.Store(key, job)
+		if loaded {
+			job.previous = value.(*combineJob)
+			log.Infof("Superseding in-flight run for %s (triggered from MR #%d)", key, job.previous.mergeRequestIID)
+			job.previous.cancel(errSuperseded)
+		}
+		return true
+	})
+	if err == nil && yielded {
+		return errRunning
+	}
+	return err
+}
+
+// scheduleRefresh debounces push-driven rebuilds: a burst of pushes to the
+// same project results in a single combine REFRESH_DELAY after the last one.
+func (s *Server) scheduleRefresh(trigger combineTrigger, profile config.Profile) {
+	key := runKey{projectID: trigger.projectID, targetBranch: profile.TargetBranch}
+
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+
+	if timer, ok := s.refreshTimers[key]; ok {
+		timer.Stop()
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(config.RefreshDelay, func() {
+		s.refreshMu.Lock()
+		if s.refreshTimers[key] != timer {
+			s.refreshMu.Unlock()
+			return
+		}
+		delete(s.refreshTimers, key)
+		s.refreshMu.Unlock()
+
+		if profile.Frozen(time.Now()) {
+			log.Infof("Refresh of %s skipped: profile %s is in a freeze window", key, profile.Name)
+			return
+		}
+
+		job := s.newTriggeredJob(trigger, profile)
+		job.refresh = true
+		if err := s.startMergeProcess(job); err != nil {
+			log.Errorf("Scheduled refresh for %s not queued: %v", key, err)
+		}
+	})
+	s.refreshTimers[key] = timer
+	log.Infof("Refresh of %s scheduled in %s", key, config.RefreshDelay)
+}
+
+func (s *Server) executeJob(job *combineJob) {
+	defer close(job.done)
+	defer s.activeProjects.CompareAndDelete(job.key(), job)
+	defer s.lastRuns.Store(job.key(), job)
+	defer s.recoverJob(job)
+
+	if job.previous != nil {
+		<-job.previous.done
+		job.previous = nil
+	}
+
+	log.WithField("run_id", job.id).Infof("Starting combine for %s", job.key())
+	job.setState(jobRunning)
+	s.runCombine(job)
+}
+
+// recoverJob keeps a panicking run from taking the whole server down. The
+// deferred calls in executeJob still release the project lock afterwards.
+func (s *Server) recoverJob(job *combineJob) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+
+	log.WithField("run_id", job.id).Errorf("Combine run panicked: %v\n%s", recovered, debug.Stack())
+	job.setState(jobFailed)
+	s.notifyInternalError(job)
+}
+
+func (s *Server) runCombine(job *combineJob) {
+	hasError, err := s.combineAllMRs(job)
+	switch {
+	case job.superseded():
+		job.setState(jobSuperseded)
+		s.notifySuperseded(job)
+	case job.cancelled():
+		job.setState(jobCancelled)
+		s.notifyCancelled(job)
+	case errors.Is(err, errUnchanged), errors.Is(err, errScheduled), errors.Is(err, errNoBranch):
+		job.setState(jobSkipped)
+		log.WithField("run_id", job.id).Infof("Skipping combine for %s: %v", job.key(), err)
+	case err != nil:
+		job.setState(jobFailed)
+		s.handleErrorAndNotify(job, err.Error())
+	default:
+		if hasError {
+			job.setState(jobFailed)
+		} else {
+			job.setState(jobSucceeded)
+		}
+		s.addCommentToBuffer(job, fmt.Sprintf("Merged MRs into %s", job.targetBranch))
+		s.sendComments(job, hasError)
+	}
+}
+
+func (s *Server) isProjectActive(projectID int) bool {
+	active := false
+	s.activeProjects.Range(func(key, _ any) bool {
+		if k, ok := key.(runKey); ok && k.projectID == projectID {
+			active = true
+			return false
+		}
+		return true
+	})
+	return active
+}
@@ -1,63 +1,190 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"gitlab-mr-combiner/internal/config"
 	"gitlab-mr-combiner/internal/gitlab"
-	"net/http"
+	"gitlab-mr-combiner/internal/lock"
+	"gitlab-mr-combiner/internal/utils"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
-func (s *Server) combineAllMRs(projectID, mergeRequestID int, r *http.Request) {
-	log.Println("Processing MRs for project:", projectID)
-	targetBranch := s.GetQueryParam("branch", config.TargetBranch, r)
+func (s *Server) combineAllMRs(job *combineJob) (bool, error) {
+	log.Println("Processing MRs for project:", job.projectID)
 
-	repoInfo, err := s.getRepoInfo(projectID)
+	session, err := utils.NewSSHSession()
 	if err != nil {
-		s.handleErrorAndNotify(projectID, mergeRequestID, fmt.Sprintf("Error fetching repo info: %v", err), r)
-		return
+		return false, err
 	}
+	defer session.Close()
 
-	s.addCommentToBuffer(mergeRequestID, fmt.Sprintf("Repo Info: Branch=%s, URL=%s", repoInfo.DefaultBranch, repoInfo.RepoURL))
+	ctx, cancel := context.WithTimeout(session.Context(job.ctx), config.RunTimeout)
+	defer cancel()
 
-	clonePath := filepath.Join("/gitlab-combiner", fmt.Sprintf("project-%d", projectID))
-	hasError := false
+	var repoInfo *gitlab.RepoInfo
+	err = s.runStep(ctx, "fetch repo info", func(ctx context.Context) (err error) {
+		repoInfo, err = s.forge.repoInfo(ctx, job.projectID)
+		return err
+	})
+	if err != nil {
+		return false, fmt.Errorf("Error fetching repo info: %w", err)
+	}
+
+	s.addCommentToBuffer(job, fmt.Sprintf("Repo Info: Branch=%s, URL=%s", repoInfo.DefaultBranch, repoInfo.CloneURL()))
+
+	if job.targetBranch == repoInfo.DefaultBranch {
+		return false, errors.New("Target branch is the same as the default branch")
+	}
+
+	var mergeRequests []gitlab.MergeRequest
+	err = s.runStep(ctx, "fetch merge requests", func(ctx context.Context) (err error) {
+		mergeRequests, err = s.forge.labeledChanges(ctx, job.projectID, repoInfo.PathWithNamespace, job.profile.Label)
+		return err
+	})
+	if err != nil {
+		return false, fmt.Errorf("Error fetching MRs: %w", err)
+	}
+
+	s.addCommentToBuffer(job, fmt.Sprintf("Found %d MRs", len(mergeRequests)))
 
-	if err := s.prepareRepository(clonePath, repoInfo, targetBranch); err != nil {
-		s.handleErrorAndNotify(projectID, mergeRequestID, err.Error(), r)
-		return
+	// Pushes and schedules reach projects nobody has labeled anything in.
+	// Without MRs the run would force-push a copy of the default branch,
+	// so it only goes ahead when there is a combined branch to update.
+	if len(mergeRequests) == 0 && (job.refresh || job.skipUnchanged) {
+		err = s.runStep(ctx, "fetch combined branch", func(ctx context.Context) error {
+			_, err := s.forge.branchSHA(ctx, job.projectID, job.targetBranch)
+			return err
+		})
+		if gitlab.IsNotFound(err) {
+			return false, errNoBranch
+		}
+		if err != nil {
+			return false, fmt.Errorf("Error fetching combined branch: %w", err)
+		}
 	}
 
-	if targetBranch == repoInfo.DefaultBranch {
-		s.handleErrorAndNotify(projectID, mergeRequestID, "Target branch is the same as the default branch", r)
-		return
+	var fingerprint string
+	err = s.runStep(ctx, "fetch default branch", func(ctx context.Context) error {
+		sha, err := s.forge.branchSHA(ctx, job.projectID, repoInfo.DefaultBranch)
+		if err != nil {
+			return err
+		}
+		fingerprint = inputsFingerprint(sha, mergeRequests)
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("Error fetching default branch: %w", err)
 	}
 
-	mergeRequests, err := s.fetchMergeRequests(projectID)
+	if job.skipUnchanged {
+		if err := s.claimSchedule(ctx, job, repoInfo); err != nil {
+			return false, err
+		}
+		if last, ok := s.pushedInputs.Load(job.key()); ok && last == fingerprint {
+			return false, errUnchanged
+		}
+	}
+
+	lease, err := s.locker.Acquire(ctx, lock.Key{ProjectID: job.projectID, Branch: job.targetBranch, RepoURL: repoInfo.CloneURL()})
 	if err != nil {
-		s.handleErrorAndNotify(projectID, mergeRequestID, fmt.Sprintf("Error fetching MRs: %v", err), r)
-		return
+		if job.interrupted() {
+			return false, context.Cause(job.ctx)
+		}
+		return false, fmt.Errorf("Error acquiring combine lock: %v", err)
 	}
+	defer s.releaseLock(ctx, lease, job)
+
+	clonePath := filepath.Join(config.WorkDir, fmt.Sprintf("project-%d", job.projectID), url.PathEscape(job.targetBranch))
+	// Each run clones afresh, so the clone is dropped again while the lock is
+	// still held instead of piling up under WORK_DIR.
+	defer func() {
+		if err := os.RemoveAll(clonePath); err != nil {
+			log.Warnf("Failed to remove %s: %v", clonePath, err)
+		}
+	}()
+
+	if err := s.prepareRepository(ctx, clonePath, repoInfo, job.targetBranch); err != nil {
+		return false, err
+	}
+
+	hasError, err := s.processMergeRequests(ctx, clonePath, mergeRequests, job)
+	if err != nil {
+		return hasError, err
+	}
+
+	if job.interrupted() {
+		return hasError, context.Cause(job.ctx)
+	}
+
+	if err := s.pushChanges(ctx, clonePath, job.targetBranch); err != nil {
+		return hasError, fmt.Errorf("Error pushing to remote: %v", err)
+	}
+
+	if hasError {
+		s.pushedInputs.Delete(job.key())
+	} else {
+		s.pushedInputs.Store(job.key(), fingerprint)
+	}
+	return hasError, nil
+}
+
+// inputsFingerprint identifies everything a combined branch is built from, so
+// scheduled runs can tell whether a rebuild would change anything.
+func inputsFingerprint(defaultBranchSHA string, mergeRequests []gitlab.MergeRequest) string {
+	parts := make([]string, 0, len(mergeRequests))
+	for _, mr := range mergeRequests {
+		parts = append(parts, fmt.Sprintf("%d:%s", mr.IID, mr.SHA))
+	}
+	sort.Strings(parts)
+	return defaultBranchSHA + ";" + strings.Join(parts, ",")
+}
+
+func (s *Server) releaseLock(ctx context.Context, lease lock.Lease, job *combineJob) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), config.StepTimeout)
+	defer cancel()
+
+	if err := lease.Release(ctx); err != nil {
+		log.WithField("run_id", job.id).Errorf("Failed to release lock for %s: %v", job.key(), err)
+	}
+}
 
-	s.addCommentToBuffer(mergeRequestID, fmt.Sprintf("Found %d MRs", len(mergeRequests)))
+func (s *Server) runStep(ctx context.Context, step string, fn func(ctx context.Context) error) error {
+	stepCtx, cancel := context.WithTimeout(ctx, config.StepTimeout)
+	defer cancel()
 
-	hasError = s.processMergeRequests(clonePath, mergeRequests, targetBranch, mergeRequestID)
+	err := fn(stepCtx)
+	if err == nil {
+		return nil
+	}
 
-	if err := s.pushChanges(clonePath, targetBranch); err != nil {
-		s.handleErrorAndNotify(projectID, mergeRequestID, fmt.Sprintf("Error pushing to remote: %v", err), r)
-		return
+	if cause := context.Cause(ctx); errors.Is(cause, errSuperseded) || errors.Is(cause, errCancelled) {
+		return cause
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &timeoutError{step: step, timeout: config.RunTimeout, run: true}
+	}
+	if errors.Is(stepCtx.Err(), context.DeadlineExceeded) {
+		return &timeoutError{step: step, timeout: config.StepTimeout}
 	}
+	return err
+}
 
-	s.addCommentToBuffer(mergeRequestID, fmt.Sprintf("Merged MRs into %s", targetBranch))
-	s.sendComments(projectID, mergeRequestID, hasError, r)
+func (s *Server) runGit(ctx context.Context, args ...string) ([]byte, error) {
+	return utils.GitCommandContext(ctx, args...).CombinedOutput()
 }
 
-func (s *Server) prepareRepository(clonePath string, repoInfo *gitlab.RepoInfo, targetBranch string) error {
+func (s *Server) prepareRepository(ctx context.Context, clonePath string, repoInfo *gitlab.RepoInfo, targetBranch string) error {
 	if _, err := os.Stat(clonePath); !os.IsNotExist(err) {
 		log.Infof("Repository directory exists, removing it: %s", clonePath)
 		if err := os.RemoveAll(clonePath); err != nil {
@@ -66,14 +193,19 @@ func (s *Server) prepareRepository(clonePath string, repoInfo *gitlab.RepoInfo,
 	}
 
 	log.Infof("Cloning repository to %s", clonePath)
-	cloneCmd := exec.Command("git", "clone", "--branch", repoInfo.DefaultBranch, repoInfo.RepoURL, clonePath)
-	output, err := cloneCmd.CombinedOutput()
+	var output []byte
+	err := s.runStep(ctx, "clone repository", func(ctx context.Context) (err error) {
+		output, err = s.runGit(ctx, "clone", "--branch", repoInfo.DefaultBranch, repoInfo.CloneURL(), clonePath)
+		return err
+	})
 	if err != nil {
 		return fmt.Errorf("error cloning repo: %v, output: %s", err, output)
 	}
 
-	createBranchCmd := exec.Command("git", "-C", clonePath, "checkout", "-b", targetBranch)
-	output, err = createBranchCmd.CombinedOutput()
+	err = s.runStep(ctx, "create target branch", func(ctx context.Context) (err error) {
+		output, err = s.runGit(ctx, "-C", clonePath, "checkout", "-b", targetBranch)
+		return err
+	})
 	if err != nil {
 		return fmt.Errorf("error creating target branch from default branch: %v, output: %s", err, output)
 	}
@@ -81,79 +213,203 @@ func (s *Server) prepareRepository(clonePath string, repoInfo *gitlab.RepoInfo,
 	return nil
 }
 
-func (s *Server) processMergeRequests(clonePath string, mergeRequests []gitlab.MergeRequest, targetBranch string, mergeRequestID int) bool {
+func (s *Server) processMergeRequests(ctx context.Context, clonePath string, mergeRequests []gitlab.MergeRequest, job *combineJob) (bool, error) {
 	hasError := false
 
 	for _, mr := range mergeRequests {
-		if err := s.processSingleMergeRequest(clonePath, mr, targetBranch, mergeRequestID); err != nil {
+		if err := s.processSingleMergeRequest(ctx, clonePath, mr, job); err != nil {
 			hasError = true
 		}
+
+		if job.interrupted() {
+			return hasError, context.Cause(job.ctx)
+		}
+		if ctx.Err() != nil {
+			return hasError, &timeoutError{step: fmt.Sprintf("merge MR #%d", mr.IID), timeout: config.RunTimeout, run: true}
+		}
 	}
 
-	return hasError
+	return hasError, nil
 }
 
-func (s *Server) processSingleMergeRequest(clonePath string, mr gitlab.MergeRequest, targetBranch string, mergeRequestID int) error {
+func (s *Server) processSingleMergeRequest(ctx context.Context, clonePath string, mr gitlab.MergeRequest, job *combineJob) error {
 	mrBranchName := fmt.Sprintf("mr-%d", mr.IID)
 
-	fetchCmd := exec.Command("git", "-C", clonePath, "fetch", "origin", fmt.Sprintf("merge-requests/%d/head:%s", mr.IID, mrBranchName))
-	output, err := fetchCmd.CombinedOutput()
+	var output []byte
+	err := s.runStep(ctx, fmt.Sprintf("fetch MR #%d", mr.IID), func(ctx context.Context) (err error) {
+		output, err = s.runGit(ctx, "-C", clonePath, "fetch", "origin", fmt.Sprintf("%s:%s", s.forge.headRef(mr.IID), mrBranchName))
+		return err
+	})
 	if err != nil {
 		errMsg := fmt.Sprintf("Error fetching MR #%d: %v, output: %s", mr.IID, err, output)
-		s.addCommentToBuffer(mergeRequestID, errMsg)
-		return fmt.Errorf(errMsg)
+		s.addCommentToBuffer(job, errMsg)
+		return errors.New(errMsg)
+	}
+
+	// The listed SHA must still be reachable from the MR head; a force push
+	// since listing would otherwise merge commits nobody asked for.
+	err = s.runStep(ctx, fmt.Sprintf("verify MR #%d", mr.IID), func(ctx context.Context) (err error) {
+		output, err = s.runGit(ctx, "-C", clonePath, "merge-base", "--is-ancestor", mr.SHA, mrBranchName)
+		return err
+	})
+	if err != nil {
+		errMsg := fmt.Sprintf("Error verifying MR #%d: %v, output: %s", mr.IID, err, output)
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			errMsg = fmt.Sprintf("Error merging MR #%d: listed commit %s is no longer part of the MR", mr.IID, shortSHA(mr.SHA))
+		}
+		log.Print(errMsg)
+		s.addCommentToBuffer(job, errMsg)
+		return errors.New(errMsg)
 	}
 
-	checkoutCmd := exec.Command("git", "-C", clonePath, "checkout", targetBranch)
-	output, err = checkoutCmd.CombinedOutput()
+	err = s.runStep(ctx, "checkout target branch", func(ctx context.Context) (err error) {
+		output, err = s.runGit(ctx, "-C", clonePath, "checkout", job.targetBranch)
+		return err
+	})
 	if err != nil {
 		errMsg := fmt.Sprintf("Error checking out branch: %v, output: %s", err, output)
-		log.Printf(errMsg)
-		s.addCommentToBuffer(mergeRequestID, errMsg)
-		return fmt.Errorf(errMsg)
+		log.Print(errMsg)
+		s.addCommentToBuffer(job, errMsg)
+		return errors.New(errMsg)
 	}
 
-	mergeCmd := exec.Command("git", "-C", clonePath, "merge", "--no-ff", mrBranchName)
-	output, err = mergeCmd.CombinedOutput()
+	err = s.runStep(ctx, fmt.Sprintf("merge MR #%d", mr.IID), func(ctx context.Context) (err error) {
+		message := fmt.Sprintf("Merge branch '%s' into %s (%s)", mr.SourceBranch, job.targetBranch, s.forge.reference(mr.IID))
+		output, err = s.runGit(ctx, "-C", clonePath, "merge", "--no-ff", "-m", message, mr.SHA)
+		return err
+	})
 	if err != nil {
 		errMsg := fmt.Sprintf("Error merging MR #%d: %v, output: %s", mr.IID, err, output)
-		log.Printf(errMsg)
-		s.addCommentToBuffer(mergeRequestID, errMsg)
-		return fmt.Errorf(errMsg)
+		log.Print(errMsg)
+		s.addCommentToBuffer(job, errMsg)
+		return errors.New(errMsg)
 	}
 
-	s.addCommentToBuffer(mergeRequestID, fmt.Sprintf("Merged MR #%d: %s", mr.IID, mr.Title))
+	s.addCommentToBuffer(job, fmt.Sprintf("Merged MR #%d: %s (%s)", mr.IID, mr.Title, s.mergeRequestDetails(ctx, job.projectID, mr)))
 	return nil
 }
 
-func (s *Server) pushChanges(clonePath, targetBranch string) error {
-	pushCmd := exec.Command("git", "-C", clonePath, "push", "origin", targetBranch, "--force")
-	output, err := pushCmd.CombinedOutput()
+// mergeRequestDetails describes a merged MR for the report. REST list
+// endpoints omit the head pipeline and mergeability, so they are looked up
+// separately for MRs not discovered through GraphQL; a failed lookup only
+// shortens the report.
+func (s *Server) mergeRequestDetails(ctx context.Context, projectID int, mr gitlab.MergeRequest) string {
+	if mr.HeadPipeline == nil && mr.Approvals == nil {
+		if detailed, err := s.forge.change(ctx, projectID, mr.IID); err == nil {
+			mr.HeadPipeline = detailed.HeadPipeline
+			if mr.DetailedMergeStatus == "" {
+				mr.DetailedMergeStatus = detailed.DetailedMergeStatus
+			}
+		} else {
+			log.Warnf("Failed to fetch details of MR #%d: %v", mr.IID, err)
+		}
+	}
+
+	details := []string{fmt.Sprintf("%s@%s", mr.SourceBranch, shortSHA(mr.SHA))}
+	if mr.Author.Username != "" {
+		details = append(details, "by @"+mr.Author.Username)
+	}
+	if mr.SourceProjectID != 0 && mr.SourceProjectID != mr.TargetProjectID {
+		details = append(details, fmt.Sprintf("from fork %d", mr.SourceProjectID))
+	}
+	if mr.Draft {
+		details = append(details, "draft")
+	}
+	if mr.DetailedMergeStatus != "" {
+		details = append(details, "merge status "+mr.DetailedMergeStatus)
+	}
+	if mr.HeadPipeline != nil {
+		details = append(details, "pipeline "+mr.HeadPipeline.Status)
+	}
+	if mr.Approvals != nil && mr.Approvals.Required > 0 {
+		details = append(details, fmt.Sprintf("%d/%d approvals", mr.Approvals.Required-mr.Approvals.Left, mr.Approvals.Required))
+	}
+	if mr.WebURL != "" {
+		details = append(details, mr.WebURL)
+	}
+	return strings.Join(details, ", ")
+}
+
+func shortSHA(sha string) string {
+	if len(sha) > 8 {
+		return sha[:8]
+	}
+	return sha
+}
+
+func (s *Server) pushChanges(ctx context.Context, clonePath, targetBranch string) error {
+	var output []byte
+	err := s.runStep(ctx, "push target branch", func(ctx context.Context) (err error) {
+		output, err = s.runGit(ctx, "-C", clonePath, "push", "origin", targetBranch, "--force")
+		return err
+	})
 	if err != nil {
 		return fmt.Errorf("error pushing to remote: %v, output: %s", err, output)
 	}
 	return nil
 }
 
-func (s *Server) handleErrorAndNotify(projectID, mergeRequestID int, errorMessage string, r *http.Request) {
-	s.addCommentToBuffer(mergeRequestID, errorMessage)
-	s.sendComments(projectID, mergeRequestID, true, r)
+func (s *Server) handleErrorAndNotify(job *combineJob, errorMessage string) {
+	s.addCommentToBuffer(job, errorMessage)
+	s.sendComments(job, true)
 }
 
-func (s *Server) fetchMergeRequests(projectID int) ([]gitlab.MergeRequest, error) {
-	data, err := s.apiClient.Send("GET", fmt.Sprintf("/projects/%d/merge_requests?state=opened&labels=%s", projectID, config.TriggerTag), nil)
+func (s *Server) fetchBranch(ctx context.Context, projectID int, branch string) (*gitlab.Branch, error) {
+	data, err := s.apiClient.Send(ctx, "GET", fmt.Sprintf("/projects/%d/repository/branches/%s", projectID, url.PathEscape(branch)), nil)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(data) == 0 {
-		return nil, fmt.Errorf("empty response from GitLab API")
+	var result gitlab.Branch
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, err
 	}
+	return &result, nil
+}
 
-	var mergeRequests []gitlab.MergeRequest
-	if err := json.Unmarshal(data, &mergeRequests); err != nil {
+func (s *Server) fetchMergeRequest(ctx context.Context, projectID, mergeRequestIID int) (*gitlab.MergeRequest, error) {
+	data, err := s.apiClient.Send(ctx, "GET", fmt.Sprintf("/projects/%d/merge_requests/%d", projectID, mergeRequestIID), nil)
+	if err != nil {
 		return nil, err
 	}
 
-	return mergeRequests, nil
+	var mergeRequest gitlab.MergeRequest
+	if err := json.Unmarshal(data, &mergeRequest); err != nil {
+		return nil, err
+	}
+	return &mergeRequest, nil
+}
+
+// discoverMergeRequests fetches the labeled MRs with a single GraphQL query
+// and falls back to the REST list on GitLab versions whose GraphQL API lacks
+// the fields, remembering the outcome so later runs go straight to REST.
+func (s *Server) discoverMergeRequests(ctx context.Context, projectID int, projectPath, label string) ([]gitlab.MergeRequest, error) {
+	if !s.restDiscovery.Load() && projectPath != "" {
+		mergeRequests, err := gitlab.LabeledMergeRequests(ctx, s.apiClient, projectPath, label)
+		if !gitlab.IsGraphQLUnsupported(err) {
+			return mergeRequests, err
+		}
+		log.Warnf("GraphQL merge request discovery is not supported, falling back to REST: %v", err)
+		s.restDiscovery.Store(true)
+	}
+	return s.fetchMergeRequests(ctx, projectID, label)
+}
+
+func (s *Server) fetchMergeRequests(ctx context.Context, projectID int, label string) ([]gitlab.MergeRequest, error) {
+	endpoint := fmt.Sprintf("/projects/%d/merge_requests?state=opened&labels=%s", projectID, url.QueryEscape(label))
+	return gitlab.List[gitlab.MergeRequest](ctx, s.apiClient, endpoint)
+}
+
+type timeoutError struct {
+	step    string
+	timeout time.Duration
+	run     bool
+}
+
+func (e *timeoutError) Error() string {
+	if e.run {
+		return fmt.Sprintf("combine run timed out after %s during step %q", e.timeout, e.step)
+	}
+	return fmt.Sprintf("step %q timed out after %s", e.step, e.timeout)
 }
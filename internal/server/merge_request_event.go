@@ -0,0 +1,165 @@
+package server
+
+import (
+	"fmt"
+
+	"gitlab-mr-combiner/internal/config"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	actionOpen   = "open"
+	actionUpdate = "update"
+	actionClose  = "close"
+	actionMerge  = "merge"
+	actionReopen = "reopen"
+
+	reasonSourcePush = "new commits pushed to a labeled merge request"
+)
+
+type MergeRequestEvent struct {
+	ObjectKind       string         `json:"object_kind"`
+	Project          EventProject   `json:"project"`
+	ObjectAttributes MREventAttr    `json:"object_attributes"`
+	Labels           []EventLabel   `json:"labels"`
+	Changes          MREventChanges `json:"changes"`
+}
+
+type MREventAttr struct {
+	Action          string       `json:"action"`
+	IID             int          `json:"iid"`
+	TargetProjectID int          `json:"target_project_id"`
+	OldRev          string       `json:"oldrev"`
+	Labels          []EventLabel `json:"labels"`
+}
+
+// EventLabel deliberately ignores the label's project_id: it is null for
+// group labels and says nothing about the project the MR belongs to.
+type EventLabel struct {
+	Title string `json:"title"`
+}
+
+type MREventChanges struct {
+	Labels *struct {
+		Previous []EventLabel `json:"previous"`
+		Current  []EventLabel `json:"current"`
+	} `json:"labels"`
+}
+
+func (s *Server) validateMergeRequestEvent(event MergeRequestEvent) (combineTrigger, bool) {
+	mrAttr, changes := event.ObjectAttributes, event.Changes
+	if mrAttr.Labels == nil {
+		// System hook payloads only carry the top-level labels.
+		mrAttr.Labels = event.Labels
+	}
+
+	trigger := combineTrigger{
+		projectID:       event.Project.ID,
+		projectPath:     event.Project.PathWithNamespace,
+		mergeRequestIID: mrAttr.IID,
+		action:          mrAttr.Action,
+	}
+	for _, profile := range config.Profiles() {
+		reason, ok := s.mergeRequestTrigger(mrAttr, changes, profile)
+		logger := log.WithFields(log.Fields{"mr": mrAttr.IID, "action": mrAttr.Action, "profile": profile.Name})
+		if !ok {
+			logger.Infof("Merge request event ignored: %s", reason)
+			continue
+		}
+
+		logger.Infof("Merge request event accepted: %s", reason)
+		trigger.profiles = append(trigger.profiles, profile)
+		if reason == reasonSourcePush {
+			if trigger.refresh == nil {
+				trigger.refresh = map[string]bool{}
+			}
+			trigger.refresh[profile.Name] = true
+		}
+	}
+	if trigger.projectID == 0 {
+		trigger.projectID = mrAttr.TargetProjectID
+	}
+
+	trigger.namespace = namespaceOf(trigger.projectID, event.Project.PathWithNamespace)
+	return trigger, len(trigger.profiles) > 0
+}
+
+// mergeRequestTrigger decides whether a merge request event should rebuild
+// the combined branch of profile. Changes to the profile label count, as do
+// a labeled MR being closed, merged or reopened, plus pushes to the source
+// branch when TRIGGER_ON_SOURCE_PUSH is enabled.
+func (s *Server) mergeRequestTrigger(mrAttr MREventAttr, changes MREventChanges, profile config.Profile) (string, bool) {
+	labeled := hasLabel(mrAttr.Labels, profile.Label)
+
+	switch mrAttr.Action {
+	case actionOpen, actionClose, actionMerge, actionReopen:
+		if labeled {
+			return fmt.Sprintf("labeled merge request was %s", actionPastTense(mrAttr.Action)), true
+		}
+		return fmt.Sprintf("%s merge request without the combine label", actionPastTense(mrAttr.Action)), false
+	case actionUpdate:
+	default:
+		return fmt.Sprintf("action %q is not handled", mrAttr.Action), false
+	}
+
+	if changes.Labels != nil {
+		wasLabeled := hasLabel(changes.Labels.Previous, profile.Label)
+		isLabeled := hasLabel(changes.Labels.Current, profile.Label)
+		switch {
+		case isLabeled && !wasLabeled:
+			return "combine label added", true
+		case wasLabeled && !isLabeled:
+			return "combine label removed", true
+		}
+	}
+
+	if mrAttr.OldRev != "" {
+		if !config.TriggerOnSourcePush {
+			return "source branch push, TRIGGER_ON_SOURCE_PUSH is disabled", false
+		}
+		if labeled {
+			return reasonSourcePush, true
+		}
+		return "source branch push to a merge request without the combine label", false
+	}
+
+	return "update does not change the combine label", false
+}
+
+// membershipNote explains in the report why a closed, merged or reopened MR
+// left or rejoined the combined branch.
+func membershipNote(action string, mergeRequestIID int, targetBranch string) string {
+	switch action {
+	case actionClose, actionMerge:
+		return fmt.Sprintf("MR #%d was %s and is removed from %s", mergeRequestIID, actionPastTense(action), targetBranch)
+	case actionReopen:
+		return fmt.Sprintf("MR #%d was reopened and is re-added to %s", mergeRequestIID, targetBranch)
+	default:
+		return ""
+	}
+}
+
+func actionPastTense(action string) string {
+	switch action {
+	case actionOpen:
+		return "opened"
+	case actionClose:
+		return "closed"
+	case actionMerge:
+		return "merged"
+	case actionReopen:
+		return "reopened"
+	default:
+		return action
+	}
+}
+
+func hasLabel(labels []EventLabel, title string) bool {
+	for _, label := range labels {
+		if label.Title == title {
+			return true
+		}
+	}
+	return false
+}
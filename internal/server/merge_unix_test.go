@@ -0,0 +1,56 @@
+//go:build unix
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"gitlab-mr-combiner/internal/config"
+	"gitlab-mr-combiner/internal/utils"
+)
+
+func TestRunStepKillsProcessGroupOnTimeout(t *testing.T) {
+	setConfig(t, &config.StepTimeout, 200*time.Millisecond)
+	s := NewServer()
+
+	// The shell backgrounds a second sleep, standing in for the ssh or
+	// git-remote-https children git spawns.
+	var stdout bytes.Buffer
+	var pid int
+	started := time.Now()
+	err := s.runStep(context.Background(), "sleep", func(ctx context.Context) error {
+		cmd := utils.CommandContext(ctx, "sh", "-c", "sleep 30 & echo $$; wait")
+		cmd.Stdout = &stdout
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		pid = cmd.Process.Pid
+		return cmd.Wait()
+	})
+
+	var timeout *timeoutError
+	if !errors.As(err, &timeout) || timeout.run || timeout.step != "sleep" {
+		t.Fatalf("Expected a step timeout, got %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("Expected the step to stop at its deadline, took %s", elapsed)
+	}
+	if shell := strings.TrimSpace(stdout.String()); shell != strconv.Itoa(pid) {
+		t.Fatalf("Expected the shell to report pid %d, got %q", pid, shell)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for syscall.Kill(-pid, 0) != syscall.ESRCH {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected process group %d to be gone", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
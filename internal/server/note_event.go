@@ -0,0 +1,72 @@
+package server
+
+import (
+	"gitlab-mr-combiner/internal/config"
+)
+
+const (
+	notableTypeMergeRequest = "MergeRequest"
+	actionCreate            = "create"
+)
+
+type NoteEvent struct {
+	ObjectKind       string        `json:"object_kind"`
+	Project          EventProject  `json:"project"`
+	User             EventUser     `json:"user"`
+	ObjectAttributes NoteEventAttr `json:"object_attributes"`
+	MergeRequest     *struct {
+		IID int `json:"iid"`
+	} `json:"merge_request"`
+}
+
+type NoteEventAttr struct {
+	Action      string `json:"action"`
+	Note        string `json:"note"`
+	NoteableID  int    `json:"noteable_id"`
+	NotableType string `json:"noteable_type"`
+	ProjectID   int    `json:"project_id"`
+}
+
+func (s *Server) validateNoteEvent(event NoteEvent) (combineTrigger, bool) {
+	noteAttr := event.ObjectAttributes
+
+	if noteAttr.Action != actionCreate || noteAttr.NotableType != notableTypeMergeRequest {
+		return combineTrigger{}, false
+	}
+
+	var profiles []config.Profile
+	for _, profile := range config.Profiles() {
+		if noteAttr.Note == profile.TriggerMessage {
+			profiles = append(profiles, profile)
+		}
+	}
+
+	var command *noteCommand
+	if len(profiles) == 0 {
+		parsed, ok := parseCommand(noteAttr.Note)
+		if !ok {
+			return combineTrigger{}, false
+		}
+		command, profiles = &parsed, config.Profiles()
+	}
+
+	if event.MergeRequest == nil {
+		return combineTrigger{}, false
+	}
+
+	projectID := noteAttr.ProjectID
+	if projectID == 0 {
+		projectID = event.Project.ID
+	}
+
+	return combineTrigger{
+		projectID:       projectID,
+		projectPath:     event.Project.PathWithNamespace,
+		mergeRequestIID: event.MergeRequest.IID,
+		namespace:       namespaceOf(projectID, event.Project.PathWithNamespace),
+		profiles:        profiles,
+		command:         command,
+		fromNote:        true,
+		user:            event.User,
+	}, true
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+
+	"gitlab-mr-combiner/internal/config"
+	"gitlab-mr-combiner/internal/gitlab"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// authorizeTrigger checks whether the author of a note may start a combine
+// or run a command, writes the decision to the audit log and replies with a
+// refusal on the MR. Events that carry no actor (labels, pushes, schedules)
+// are not subject to the check; a note without a user is refused.
+func (s *Server) authorizeTrigger(ctx context.Context, trigger combineTrigger) bool {
+	if !trigger.fromNote {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.StepTimeout)
+	defer cancel()
+
+	allowed, reason := false, "the note carries no user"
+	if trigger.user.ID != 0 {
+		allowed, reason = s.authorize(ctx, trigger.projectID, trigger.user)
+	}
+
+	action := "combine"
+	if trigger.command != nil {
+		action = config.CommandPrefix + " " + trigger.command.name
+	}
+	decision := "allow"
+	if !allowed {
+		decision = "deny"
+	}
+	s.audit.WithFields(log.Fields{
+		"audit":    true,
+		"decision": decision,
+		"user":     trigger.user.Username,
+		"user_id":  trigger.user.ID,
+		"project":  trigger.projectID,
+		"mr":       trigger.mergeRequestIID,
+		"action":   action,
+		"profiles": profileNames(trigger.profiles),
+		"reason":   reason,
+	}).Info("Trigger authorization")
+
+	if !allowed {
+		addressee := "Sorry"
+		if trigger.user.Username != "" {
+			addressee += " @" + trigger.user.Username
+		}
+		header := fmt.Sprintf("%s, you are not allowed to run %s on this project", addressee, action)
+		if err := s.createCommentOnMR(ctx, trigger.projectID, trigger.mergeRequestIID, reason, header); err != nil {
+			log.Errorf("Failed to reply to unauthorized trigger: %v", err)
+		}
+	}
+	return allowed
+}
+
+func (s *Server) authorize(ctx context.Context, projectID int, user EventUser) (bool, string) {
+	if slices.Contains(config.AllowedUsers, user.Username) {
+		return true, "user is listed in ALLOWED_USERS"
+	}
+
+	for _, group := range config.AllowedGroups {
+		if _, err := s.memberAccessLevel(ctx, "groups/"+url.PathEscape(group), user.ID); err == nil {
+			return true, fmt.Sprintf("user is a member of %s", group)
+		}
+	}
+
+	minLevel, err := config.AccessLevel(config.MinAccessLevel)
+	if err != nil {
+		return false, err.Error()
+	}
+	if minLevel == 0 {
+		if len(config.AllowedUsers) == 0 && len(config.AllowedGroups) == 0 {
+			return true, "MIN_ACCESS_LEVEL is none"
+		}
+		return false, "user is not listed in ALLOWED_USERS or ALLOWED_GROUPS"
+	}
+
+	level, err := s.memberAccessLevel(ctx, fmt.Sprintf("projects/%d", projectID), user.ID)
+	if gitlab.IsNotFound(err) {
+		return false, fmt.Sprintf("%s access or higher is required, the user is not a member of the project", config.AccessLevelName(minLevel))
+	}
+	if err != nil {
+		return false, fmt.Sprintf("%s access or higher is required, the project membership could not be verified: %v", config.AccessLevelName(minLevel), err)
+	}
+	if level < minLevel {
+		return false, fmt.Sprintf("%s access or higher is required, the user has %s access", config.AccessLevelName(minLevel), config.AccessLevelName(level))
+	}
+	return true, fmt.Sprintf("user has %s access", config.AccessLevelName(level))
+}
+
+// memberAccessLevel returns the access level of a direct or inherited member
+// of a project or group ("projects/<id>" or "groups/<path>").
+func (s *Server) memberAccessLevel(ctx context.Context, resource string, userID int) (int, error) {
+	data, err := s.apiClient.Send(ctx, "GET", fmt.Sprintf("/%s/members/all/%d", resource, userID), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var member struct {
+		AccessLevel int `json:"access_level"`
+	}
+	if err := json.Unmarshal(data, &member); err != nil {
+		return 0, err
+	}
+	return member.AccessLevel, nil
+}
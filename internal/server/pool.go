@@ -0,0 +1,115 @@
+package server
+
+import (
+	"errors"
+	"sync"
+
+	"gitlab-mr-combiner/internal/metrics"
+)
+
+var errQueueFull = errors.New("combine queue is full")
+
+var (
+	queueDepthGauge  = metrics.NewGaugeVec("combiner_queue_depth", "Combine jobs waiting for a free worker")
+	runningJobsGauge = metrics.NewGaugeVec("combiner_running_jobs", "Combine jobs currently running")
+	rejectedJobs     = metrics.NewCounterVec("combiner_jobs_rejected_total", "Combine jobs rejected before being queued", "reason")
+)
+
+// workerPool runs combine jobs on a fixed number of workers. Pending jobs are
+// picked in FIFO order, skipping those whose namespace is already at its
+// concurrency limit so one busy group cannot starve the others.
+type workerPool struct {
+	mu              sync.Mutex
+	cond            *sync.Cond
+	pending         []*combineJob
+	running         map[string]int
+	maxQueue        int
+	maxPerNamespace int
+	run             func(*combineJob)
+}
+
+func newWorkerPool(workers, maxQueue, maxPerNamespace int, run func(*combineJob)) *workerPool {
+	p := &workerPool{
+		running:         map[string]int{},
+		maxQueue:        maxQueue,
+		maxPerNamespace: maxPerNamespace,
+		run:             run,
+	}
+	p.cond = sync.NewCond(&p.mu)
+
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+	return p
+}
+
+// submit queues either all jobs or, when the queue cannot take them all, none
+// of them, so a retried webhook does not queue the same profiles twice.
+// Once the jobs fit, admit is called under the pool lock for every job and
+// the jobs it refuses are dropped.
+func (p *workerPool) submit(jobs []*combineJob, admit func(*combineJob) bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.maxQueue > 0 && len(p.pending)+len(jobs) > p.maxQueue {
+		rejectedJobs.Add(float64(len(jobs)), "queue_full")
+		return errQueueFull
+	}
+
+	for _, job := range jobs {
+		if admit != nil && !admit(job) {
+			continue
+		}
+		p.pending = append(p.pending, job)
+	}
+	p.updateMetrics()
+	p.cond.Broadcast()
+	return nil
+}
+
+func (p *workerPool) worker() {
+	for {
+		job := p.next()
+		p.run(job)
+		p.finish(job)
+	}
+}
+
+func (p *workerPool) next() *combineJob {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for {
+		for i, job := range p.pending {
+			if p.maxPerNamespace > 0 && p.running[job.namespace] >= p.maxPerNamespace {
+				continue
+			}
+			p.pending = append(p.pending[:i], p.pending[i+1:]...)
+			p.running[job.namespace]++
+			p.updateMetrics()
+			return job
+		}
+		p.cond.Wait()
+	}
+}
+
+func (p *workerPool) finish(job *combineJob) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.running[job.namespace]--
+	if p.running[job.namespace] <= 0 {
+		delete(p.running, job.namespace)
+	}
+	p.updateMetrics()
+	p.cond.Broadcast()
+}
+
+func (p *workerPool) updateMetrics() {
+	total := 0
+	for _, count := range p.running {
+		total += count
+	}
+	queueDepthGauge.Set(float64(len(p.pending)))
+	runningJobsGauge.Set(float64(total))
+}
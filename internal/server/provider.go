@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"gitlab-mr-combiner/internal/gitlab"
+)
+
+var errInvalidBody = errors.New("invalid request body")
+
+// unsupportedEventError is a well-formed webhook of a kind no handler exists
+// for. It is acknowledged rather than rejected, so the forge does not retry it.
+type unsupportedEventError struct {
+	kind string
+}
+
+func (e *unsupportedEventError) Error() string {
+	return fmt.Sprintf("unsupported event %q", e.kind)
+}
+
+// provider is what the combiner needs from the forge hosting the projects.
+// Changes (merge requests, pull requests) are described with the GitLab
+// models, which every provider maps its own API onto.
+type provider interface {
+	// parseWebhook decides whether a webhook triggers a combine. It returns
+	// errInvalidBody or an *unsupportedEventError when it cannot tell.
+	parseWebhook(r *http.Request, body []byte) (combineTrigger, bool, error)
+	verifyWebhook(r *http.Request, body []byte, projectID int) error
+	repoInfo(ctx context.Context, projectID int) (*gitlab.RepoInfo, error)
+	labeledChanges(ctx context.Context, projectID int, projectPath, label string) ([]gitlab.MergeRequest, error)
+	branchSHA(ctx context.Context, projectID int, branch string) (string, error)
+	change(ctx context.Context, projectID, number int) (*gitlab.MergeRequest, error)
+	comment(ctx context.Context, projectID, number int, body string) error
+	// headRef is the ref the head of a change can be fetched from.
+	headRef(number int) string
+	// reference is how commit messages refer to a change ("!12", "#12").
+	reference(number int) string
+}
+
+type gitlabProvider struct {
+	s *Server
+}
+
+func (p gitlabProvider) parseWebhook(r *http.Request, body []byte) (combineTrigger, bool, error) {
+	kind := eventKind(r, body)
+	if kind == "" {
+		return combineTrigger{}, false, errInvalidBody
+	}
+	if _, ok := eventHandlers[kind]; !ok {
+		return combineTrigger{}, false, &unsupportedEventError{kind: kind}
+	}
+
+	trigger, ok, err := p.s.validateEvent(kind, body)
+	if err != nil {
+		return combineTrigger{}, false, errInvalidBody
+	}
+	return trigger, ok, nil
+}
+
+func (p gitlabProvider) verifyWebhook(r *http.Request, _ []byte, projectID int) error {
+	return p.s.validateSecretToken(r, projectID)
+}
+
+func (p gitlabProvider) repoInfo(ctx context.Context, projectID int) (*gitlab.RepoInfo, error) {
+	return p.s.getRepoInfo(ctx, projectID)
+}
+
+func (p gitlabProvider) labeledChanges(ctx context.Context, projectID int, projectPath, label string) ([]gitlab.MergeRequest, error) {
+	return p.s.discoverMergeRequests(ctx, projectID, projectPath, label)
+}
+
+func (p gitlabProvider) branchSHA(ctx context.Context, projectID int, branch string) (string, error) {
+	result, err := p.s.fetchBranch(ctx, projectID, branch)
+	if err != nil {
+		return "", err
+	}
+	return result.Commit.ID, nil
+}
+
+func (p gitlabProvider) change(ctx context.Context, projectID, number int) (*gitlab.MergeRequest, error) {
+	return p.s.fetchMergeRequest(ctx, projectID, number)
+}
+
+func (p gitlabProvider) comment(ctx context.Context, projectID, number int, body string) error {
+	_, err := p.s.apiClient.Send(ctx, "POST", fmt.Sprintf("/projects/%d/merge_requests/%d/notes", projectID, number), map[string]string{"body": body})
+	return err
+}
+
+func (p gitlabProvider) headRef(number int) string {
+	return fmt.Sprintf("merge-requests/%d/head", number)
+}
+
+func (p gitlabProvider) reference(number int) string {
+	return fmt.Sprintf("!%d", number)
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"strings"
+
+	"gitlab-mr-combiner/internal/config"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type PushEvent struct {
+	ObjectKind   string       `json:"object_kind"`
+	ProjectID    int          `json:"project_id"`
+	Ref          string       `json:"ref"`
+	After        string       `json:"after"`
+	UserUsername string       `json:"user_username"`
+	Project      EventProject `json:"project"`
+}
+
+// validatePushEvent rebuilds every profile of a project when its default
+// branch moves. Pushes to a combined branch are the combiner's own
+// force-pushes and are ignored, otherwise every rebuild would trigger the next.
+func (s *Server) validatePushEvent(event PushEvent) (combineTrigger, bool) {
+	logger := log.WithFields(log.Fields{"ref": event.Ref, "user": event.UserUsername})
+
+	branch, isBranch := strings.CutPrefix(event.Ref, "refs/heads/")
+	if !isBranch {
+		logger.Info("Push event ignored: not a branch")
+		return combineTrigger{}, false
+	}
+
+	for _, profile := range config.Profiles() {
+		if branch == profile.TargetBranch {
+			logger.Infof("Push event ignored: %s is the combined branch of profile %s", branch, profile.Name)
+			return combineTrigger{}, false
+		}
+	}
+
+	switch {
+	case !config.TriggerOnDefaultBranchPush:
+		logger.Info("Push event ignored: TRIGGER_ON_DEFAULT_BRANCH_PUSH is disabled")
+		return combineTrigger{}, false
+	case branch != event.Project.DefaultBranch:
+		logger.Infof("Push event ignored: %s is not the default branch", branch)
+		return combineTrigger{}, false
+	case strings.Trim(event.After, "0") == "":
+		logger.Info("Push event ignored: branch was deleted")
+		return combineTrigger{}, false
+	}
+
+	projectID := event.ProjectID
+	if projectID == 0 {
+		projectID = event.Project.ID
+	}
+
+	logger.Infof("Push event accepted: default branch of project %d moved to %s", projectID, event.After)
+	trigger := combineTrigger{
+		projectID:   projectID,
+		projectPath: event.Project.PathWithNamespace,
+		namespace:   namespaceOf(projectID, event.Project.PathWithNamespace),
+		profiles:    config.Profiles(),
+		refresh:     map[string]bool{},
+	}
+	for _, profile := range trigger.profiles {
+		trigger.refresh[profile.Name] = true
+	}
+	return trigger, true
+}
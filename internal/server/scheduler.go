@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gitlab-mr-combiner/internal/config"
+	"gitlab-mr-combiner/internal/gitlab"
+	"gitlab-mr-combiner/internal/lock"
+	"gitlab-mr-combiner/internal/metrics"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const scheduleLockKind = "schedule"
+
+var scheduledRuns = metrics.NewCounterVec("combiner_scheduled_runs_total", "Scheduled rebuilds by profile and outcome", "profile", "outcome")
+
+func (s *Server) startScheduler() {
+	for _, profile := range config.Profiles() {
+		if profile.HasSchedule() {
+			go s.runSchedule(profile)
+		}
+	}
+}
+
+func (s *Server) runSchedule(profile config.Profile) {
+	for {
+		next := profile.NextRun(time.Now())
+		if next.IsZero() {
+			log.Warnf("Schedule %q of profile %s never fires again", profile.Schedule, profile.Name)
+			return
+		}
+
+		log.Infof("Next scheduled rebuild of profile %s at %s", profile.Name, next.Format(time.RFC3339))
+		time.Sleep(time.Until(next))
+		s.fireSchedule(profile, next)
+	}
+}
+
+// fireSchedule queues a rebuild of every project of profile. Runs that find
+// the same inputs as the last successful push finish without cloning.
+func (s *Server) fireSchedule(profile config.Profile, at time.Time) {
+	if profile.Frozen(at) {
+		log.Infof("Scheduled rebuild of profile %s skipped: freeze window", profile.Name)
+		scheduledRuns.Inc(profile.Name, "frozen")
+		return
+	}
+
+	for _, projectID := range profile.Projects {
+		// The namespace decides which MAX_COMBINES_PER_NAMESPACE budget the run
+		// counts against, so it has to come from the project path like it does
+		// for webhooks.
+		ctx, cancel := context.WithTimeout(context.Background(), config.StepTimeout)
+		repoInfo, err := s.forge.repoInfo(ctx, projectID)
+		cancel()
+		if err != nil {
+			log.Errorf("Scheduled rebuild of project %d (profile %s) not queued: error resolving project: %v", projectID, profile.Name, err)
+			scheduledRuns.Inc(profile.Name, "rejected")
+			continue
+		}
+
+		job := newCombineJob(projectID, 0, profile)
+		job.namespace = namespaceOf(projectID, repoInfo.PathWithNamespace)
+		job.skipUnchanged = true
+
+		err = s.startMergeProcess(job)
+		if errors.Is(err, errRunning) {
+			log.Infof("Scheduled rebuild of project %d (profile %s) skipped: %v", projectID, profile.Name, err)
+			scheduledRuns.Inc(profile.Name, "running")
+			continue
+		}
+		if err != nil {
+			log.Errorf("Scheduled rebuild of project %d (profile %s) not queued: %v", projectID, profile.Name, err)
+			scheduledRuns.Inc(profile.Name, "rejected")
+			continue
+		}
+		scheduledRuns.Inc(profile.Name, "queued")
+	}
+}
+
+// claimSchedule lets one replica act on a scheduled run. The winner keeps the
+// schedule lock, and with it the fingerprint of its last push, until its next
+// scheduled run of the branch renews it; the other replicas skip.
+func (s *Server) claimSchedule(ctx context.Context, job *combineJob, repoInfo *gitlab.RepoInfo) error {
+	if previous, ok := s.scheduleLeases.LoadAndDelete(job.key()); ok {
+		s.releaseLock(ctx, previous.(lock.Lease), job)
+	}
+
+	key := lock.Key{ProjectID: job.projectID, Branch: job.targetBranch, RepoURL: repoInfo.CloneURL(), Kind: scheduleLockKind}
+	lease, err := s.locker.TryAcquire(ctx, key)
+	if errors.Is(err, lock.ErrHeld) {
+		return errScheduled
+	}
+	if err != nil {
+		return fmt.Errorf("Error acquiring schedule lock: %v", err)
+	}
+	s.scheduleLeases.Store(job.key(), lease)
+	return nil
+}
@@ -1,13 +1,22 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"gitlab-mr-combiner/internal/config"
 	"gitlab-mr-combiner/internal/gitlab"
+	"gitlab-mr-combiner/internal/lock"
+	"gitlab-mr-combiner/internal/metrics"
 	"gitlab-mr-combiner/internal/utils"
 
 	log "github.com/sirupsen/logrus"
@@ -15,50 +24,37 @@ import (
 
 type Server struct {
 	apiClient      *gitlab.ApiClient
+	forge          provider
 	activeProjects sync.Map
-	commentsBuffer sync.Map
-}
-
-type WebhookEvent struct {
-	ObjectKind   string          `json:"object_kind"`
-	EventType    string          `json:"event_type"`
-	ProjectID    int             `json:"project_id"`
-	ObjectAttr   json.RawMessage `json:"object_attributes"`
-	MergeRequest json.RawMessage `json:"merge_request"`
-	Labels       []struct {
-		Title string `json:"title"`
-	} `json:"labels"`
-}
-
-type NoteEventAttr struct {
-	Action      string `json:"action"`
-	Note        string `json:"note"`
-	NoteableID  int    `json:"noteable_id"`
-	NotableType string `json:"noteable_type"`
-	ProjectID   int    `json:"project_id"`
-}
-
-type MREventAttr struct {
-	Action string `json:"action"`
-	IID    int    `json:"iid"`
-	Labels []struct {
-		Title     string `json:"title"`
-		ProjectID int    `json:"project_id"`
-	} `json:"labels"`
+	refreshMu      sync.Mutex
+	refreshTimers  map[runKey]*time.Timer
+	pushedInputs   sync.Map
+	scheduleLeases sync.Map
+	lastRuns       sync.Map
+	recentEvents   *eventCache
+	pool           *workerPool
+	locker         lock.Locker
+	audit          *log.Logger
+	restDiscovery  atomic.Bool
+	tokenStatus    atomic.Pointer[tokenStatus]
 }
 
 const (
-	eventTypeNote        = "note"
-	eventTypeMergeRequest = "merge_request"
-	notableTypeMergeRequest = "MergeRequest"
-	actionCreate         = "create"
-	actionUpdate         = "update"
+	queueRetryAfterSeconds = 30
+	maxWebhookBodyBytes    = 10 << 20
 )
 
 func NewServer() *Server {
-	return &Server{
-		apiClient: gitlab.NewApiClient(),
+	s := &Server{
+		apiClient:     gitlab.NewApiClient(),
+		locker:        lock.MemoryLocker{},
+		refreshTimers: map[runKey]*time.Timer{},
+		recentEvents:  newEventCache(config.DedupTTL, config.DedupMaxEntries),
+		audit:         log.StandardLogger(),
 	}
+	s.forge = gitlabProvider{s: s}
+	s.pool = newWorkerPool(config.MaxConcurrentCombines, config.QueueSize, config.MaxCombinesPerNamespace, s.executeJob)
+	return s
 }
 
 func (s *Server) Init() {
@@ -66,136 +62,234 @@ func (s *Server) Init() {
 	utils.InitGitConfig()
 	utils.InitLogger()
 
+	if err := utils.InitSSH(); err != nil {
+		log.Fatalf("Invalid SSH settings: %v", err)
+	}
+
+	options, err := apiClientOptions()
+	if err != nil {
+		log.Fatalf("Invalid GitLab client settings: %v", err)
+	}
+	s.apiClient = gitlab.NewApiClient(options...)
+	if config.Forge == config.ForgeGitHub {
+		s.forge = newGitHubProvider(s, options...)
+	}
+
+	locker, err := lock.New(config.LockBackend, config.LockDir, config.ReplicaID, config.LockTTL)
+	if err != nil {
+		log.Fatalf("Invalid LOCK_BACKEND: %v", err)
+	}
+	s.locker = locker
+	log.Infof("Using %s lock backend as %s", config.LockBackend, config.ReplicaID)
+
+	audit, err := utils.NewAuditLogger(config.AuditLogFile)
+	if err != nil {
+		log.Fatalf("Invalid AUDIT_LOG_FILE: %v", err)
+	}
+	s.audit = audit
+
+	if config.Forge == config.ForgeGitLab {
+		s.startTokenCheck()
+	}
+	s.startScheduler()
+
+	http.HandleFunc("/healthz", s.handleHealth)
+	http.HandleFunc("/metrics", metrics.Handler)
 	http.HandleFunc("/", s.handleWebhook)
 	log.Info("Server is running on port 8080")
 	log.Fatal(http.ListenAndServe(":8080", nil))
 }
 
+func apiClientOptions() ([]gitlab.Option, error) {
+	options := []gitlab.Option{gitlab.WithTimeout(config.APITimeout)}
+
+	if config.GitlabProxy != "" {
+		proxyURL, err := url.Parse(config.GitlabProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GITLAB_PROXY: %v", err)
+		}
+		options = append(options, gitlab.WithProxy(proxyURL))
+	}
+
+	if len(config.GitlabCABundles) > 0 || config.GitlabClientCert != "" {
+		tlsConfig, err := gitlab.TLSConfig(config.GitlabCABundles, config.GitlabClientCert, config.GitlabClientKey)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, gitlab.WithTLSConfig(tlsConfig))
+	}
+	return options, nil
+}
+
+// handleWebhook acknowledges redelivered events with a 200 without doing the
+// work again. A delivery ID is forgotten when its first delivery was not
+// answered with success, so GitLab's retry of a failed delivery still counts.
 func (s *Server) handleWebhook(w http.ResponseWriter, r *http.Request) {
-	event, err := s.parseWebhookEvent(r)
+	ids := eventIDs(r)
+	if len(ids) > 0 {
+		if !s.recentEvents.add(ids, time.Now()) {
+			duplicateEvents.Inc()
+			log.Infof("Duplicate webhook delivery ignored: %v", ids)
+			s.respondWithMessage(w, "Duplicate event ignored")
+			return
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			if recorder.status >= 300 {
+				s.recentEvents.remove(ids)
+			}
+		}()
+		w = recorder
+	}
+
+	s.dispatchWebhook(w, r)
+}
+
+func (s *Server) dispatchWebhook(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodyBytes))
 	if err != nil {
 		s.respondWithError(w, http.StatusBadRequest, "Invalid request body")
 		return
 	}
 
-	projectID, mergeRequestIID, isValidEvent := s.validateEvent(*event)
-	if !isValidEvent {
+	trigger, isValidEvent, err := s.forge.parseWebhook(r, body)
+	var unsupported *unsupportedEventError
+	switch {
+	case errors.As(err, &unsupported):
+		unknownEvents.Inc(metricKind(unsupported.kind))
+		log.Infof("Unsupported webhook event %q ignored", unsupported.kind)
+		s.respondWithMessage(w, fmt.Sprintf("Unsupported event: %s", unsupported.kind))
+		return
+	case err != nil:
+		s.respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	case !isValidEvent:
 		s.respondWithMessage(w, "Event ignored")
 		return
 	}
 
-	if err := s.processWebhookEvent(w, r, projectID, mergeRequestIID); err != nil {
+	if err := s.processWebhookEvent(w, r, body, trigger); err != nil {
 		log.Errorf("Error processing webhook: %v", err)
-		s.respondWithError(w, http.StatusInternalServerError, "Failed to process event")
 	}
 }
 
-func (s *Server) parseWebhookEvent(r *http.Request) (*WebhookEvent, error) {
-	var event WebhookEvent
-	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
-		return nil, err
-	}
-	return &event, nil
-}
-
-func (s *Server) validateEvent(event WebhookEvent) (int, int, bool) {
-	switch event.EventType {
-	case eventTypeNote:
-		return s.validateNoteEvent(event)
-	case eventTypeMergeRequest:
-		return s.validateMergeRequestEvent(event)
-	default:
-		return 0, 0, false
+func (s *Server) processWebhookEvent(w http.ResponseWriter, r *http.Request, body []byte, trigger combineTrigger) error {
+	if err := s.forge.verifyWebhook(r, body, trigger.projectID); err != nil {
+		s.respondWithError(w, http.StatusUnauthorized, "Invalid secret token")
+		return err
 	}
-}
 
-func (s *Server) validateNoteEvent(event WebhookEvent) (int, int, bool) {
-	var noteAttr NoteEventAttr
-	if err := json.Unmarshal(event.ObjectAttr, &noteAttr); err != nil {
-		return 0, 0, false
-	}
-	
-	if noteAttr.Action != actionCreate || 
-	   noteAttr.Note != config.TriggerMessage || 
-	   noteAttr.NotableType != notableTypeMergeRequest {
-		return 0, 0, false
+	if err := s.resolveProject(r.Context(), &trigger); err != nil {
+		s.respondWithError(w, http.StatusBadGateway, "Failed to resolve project")
+		return err
 	}
-	
-	var mergeRequest struct {
-		IID int `json:"iid"`
+	if !config.ProjectAllowed(trigger.projectID, trigger.projectPath) {
+		log.Infof("Event for project %d (%s) ignored: not in PROJECT_ALLOWLIST", trigger.projectID, trigger.projectPath)
+		s.respondWithMessage(w, "Event ignored")
+		return nil
 	}
-	if err := json.Unmarshal(event.MergeRequest, &mergeRequest); err != nil {
-		return 0, 0, false
+
+	if !s.authorizeTrigger(r.Context(), trigger) {
+		s.respondWithMessage(w, "Event ignored: not authorized")
+		return nil
 	}
-	
-	return noteAttr.ProjectID, mergeRequest.IID, true
-}
 
-func (s *Server) validateMergeRequestEvent(event WebhookEvent) (int, int, bool) {
-	var mrAttr MREventAttr
-	if err := json.Unmarshal(event.ObjectAttr, &mrAttr); err != nil {
-		return 0, 0, false
+	// config.Profiles() may share its backing array with the configuration.
+	trigger.profiles = append([]config.Profile(nil), trigger.profiles...)
+	for i, profile := range trigger.profiles {
+		if profile.IsDefault() {
+			trigger.profiles[i].TargetBranch = s.GetQueryParam("branch", profile.TargetBranch, r)
+		}
 	}
-	
-	if mrAttr.Action != actionUpdate {
-		return 0, 0, false
+
+	if trigger.command != nil {
+		go s.runCommand(trigger)
+		s.respondWithMessage(w, "OK")
+		return nil
 	}
-	
-	for _, label := range mrAttr.Labels {
-		if label.Title == config.TriggerTag {
-			return label.ProjectID, mrAttr.IID, true
+
+	var jobs []*combineJob
+	for _, profile := range trigger.profiles {
+		if !trigger.refreshes(profile) {
+			jobs = append(jobs, s.newTriggeredJob(trigger, profile))
 		}
 	}
-	
-	return 0, 0, false
-}
-
-func (s *Server) processWebhookEvent(w http.ResponseWriter, r *http.Request, projectID, mergeRequestIID int) error {
-	if s.isProjectActive(projectID) {
-		s.respondWithError(w, http.StatusTooManyRequests, "Project is already being processed")
-		return fmt.Errorf("project %d is already active", projectID)
+	if len(jobs) > 0 {
+		if err := s.startMergeProcess(jobs...); err != nil {
+			w.Header().Set("Retry-After", strconv.Itoa(queueRetryAfterSeconds))
+			s.respondWithError(w, http.StatusServiceUnavailable, "Combine queue is full, retry later")
+			return fmt.Errorf("project %d not queued: %v", trigger.projectID, err)
+		}
 	}
 
-	if err := s.validateSecretToken(r, projectID); err != nil {
-		s.respondWithError(w, http.StatusUnauthorized, "Invalid secret token")
-		return err
+	for _, profile := range trigger.profiles {
+		if trigger.refreshes(profile) {
+			s.scheduleRefresh(trigger, profile)
+		}
 	}
 
-	s.startMergeProcess(projectID, mergeRequestIID, r)
 	s.respondWithMessage(w, "OK")
 	return nil
 }
 
-func (s *Server) startMergeProcess(projectID, mergeRequestIID int, r *http.Request) {
-	s.activeProjects.Store(projectID, struct{}{})
-	s.commentsBuffer = sync.Map{}
+func (s *Server) newTriggeredJob(trigger combineTrigger, profile config.Profile) *combineJob {
+	job := newCombineJob(trigger.projectID, trigger.mergeRequestIID, profile)
+	job.namespace = trigger.namespace
+	if note := membershipNote(trigger.action, trigger.mergeRequestIID, profile.TargetBranch); note != "" {
+		job.comments = append(job.comments, note)
+	}
+	return job
+}
+
+// resolveProject fills in the project ID from path_with_namespace for system
+// hook payloads that carry no usable ID, and the path when the allowlist
+// needs it to decide.
+func (s *Server) resolveProject(ctx context.Context, trigger *combineTrigger) error {
+	lookup := ""
+	switch {
+	case trigger.projectID == 0 && trigger.projectPath != "":
+		lookup = trigger.projectPath
+	case trigger.projectID == 0:
+		return fmt.Errorf("event carries neither a project ID nor a project path")
+	case trigger.projectPath == "" && len(config.ProjectAllowlist) > 0:
+		lookup = strconv.Itoa(trigger.projectID)
+	default:
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.StepTimeout)
+	defer cancel()
 
-	go func() {
-		defer s.activeProjects.Delete(projectID)
-		s.combineAllMRs(projectID, mergeRequestIID, r)
-	}()
+	project, err := s.getProject(ctx, lookup)
+	if err != nil {
+		return fmt.Errorf("error resolving project %s: %w", lookup, err)
+	}
+	trigger.projectID = project.ID
+	trigger.projectPath = project.PathWithNamespace
+	trigger.namespace = namespaceOf(project.ID, project.PathWithNamespace)
+	return nil
 }
 
 func (s *Server) validateSecretToken(r *http.Request, projectID int) error {
 	if config.SecretToken == "" {
 		return nil
 	}
-	
+
 	if r.Header.Get("X-Gitlab-Token") != config.SecretToken {
-		s.activeProjects.Delete(projectID)
-		return fmt.Errorf("invalid secret token")
+		return fmt.Errorf("invalid secret token for project %d", projectID)
 	}
-	
+
 	return nil
 }
 
-func (s *Server) isProjectActive(projectID int) bool {
-	_, ok := s.activeProjects.Load(projectID)
-	return ok
+func (s *Server) getRepoInfo(ctx context.Context, projectID int) (*gitlab.RepoInfo, error) {
+	return s.getProject(ctx, strconv.Itoa(projectID))
 }
 
-func (s *Server) getRepoInfo(projectID int) (*gitlab.RepoInfo, error) {
-	data, err := s.apiClient.Send("GET", fmt.Sprintf("/projects/%d", projectID), nil)
+// getProject looks a project up by ID or by its path with namespace.
+func (s *Server) getProject(ctx context.Context, project string) (*gitlab.RepoInfo, error) {
+	data, err := s.apiClient.Send(ctx, "GET", "/projects/"+url.PathEscape(project), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -233,4 +327,4 @@ func (s *Server) RespondWithJSON(w http.ResponseWriter, statusCode int, payload
 	if err := json.NewEncoder(w).Encode(payload); err != nil {
 		log.Errorf("Failed to encode JSON response: %v", err)
 	}
-}
\ No newline at end of file
+}
@@ -2,12 +2,28 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"gitlab-mr-combiner/internal/config"
+	"gitlab-mr-combiner/internal/gitlab"
+	"gitlab-mr-combiner/internal/lock"
+
+	log "github.com/sirupsen/logrus"
 )
 
 func TestValidateEvent(t *testing.T) {
@@ -15,53 +31,100 @@ func TestValidateEvent(t *testing.T) {
 
 	testCases := []struct {
 		name           string
-		event          WebhookEvent
+		kind           string
+		payload        string
 		expectedResult bool
 		expectedProjID int
 		expectedMRIID  int
 	}{
 		{
-			name: "Valid Note Event",
-			event: WebhookEvent{
-				EventType:  "note",
-				ObjectAttr: json.RawMessage(`{"action": "create", "note": "` + config.TriggerMessage + `", "noteable_type": "MergeRequest", "project_id": 123, "noteable_id": 456}`),
-			},
+			name:           "Valid Note Event",
+			kind:           "note",
+			payload:        `{"object_attributes": {"action": "create", "note": "` + config.TriggerMessage + `", "noteable_type": "MergeRequest", "project_id": 123, "noteable_id": 9001}, "merge_request": {"iid": 456}}`,
 			expectedResult: true,
 			expectedProjID: 123,
 			expectedMRIID:  456,
 		},
 		{
-			name: "Valid MR Event with Trigger Tag",
-			event: WebhookEvent{
-				EventType:  "merge_request",
-				ObjectAttr: json.RawMessage(`{"action": "open", "iid": 789, "labels": [{"title": "` + config.TriggerTag + `", "project_id": 321}]}`),
-			},
+			name:           "Valid MR Event with Trigger Tag",
+			kind:           "merge_request",
+			payload:        `{"project": {"id": 321}, "object_attributes": {"action": "open", "iid": 789, "labels": [{"title": "` + config.TriggerTag + `", "project_id": 321}]}}`,
 			expectedResult: true,
 			expectedProjID: 321,
 			expectedMRIID:  789,
 		},
 		{
-			name: "Invalid Note Event",
-			event: WebhookEvent{
-				EventType:  "note",
-				ObjectAttr: json.RawMessage(`{"action": "create", "note": "Wrong message", "noteable_type": "MergeRequest"}`),
-			},
+			name:           "MR Event with Trigger Tag Added",
+			kind:           "merge_request",
+			payload:        `{"project": {"id": 321}, "object_attributes": {"action": "update", "iid": 790, "labels": [{"title": "` + config.TriggerTag + `", "project_id": 321}]}, "changes": {"labels": {"previous": [], "current": [{"title": "` + config.TriggerTag + `", "project_id": 321}]}}}`,
+			expectedResult: true,
+			expectedProjID: 321,
+			expectedMRIID:  790,
+		},
+		{
+			name:           "MR Event with Trigger Tag Removed",
+			kind:           "merge_request",
+			payload:        `{"project": {"id": 321}, "object_attributes": {"action": "update", "iid": 791, "labels": []}, "changes": {"labels": {"previous": [{"title": "` + config.TriggerTag + `", "project_id": 321}], "current": []}}}`,
+			expectedResult: true,
+			expectedProjID: 321,
+			expectedMRIID:  791,
+		},
+		{
+			name:           "MR Event with Group Label",
+			kind:           "merge_request",
+			payload:        `{"project": {"id": 321}, "object_attributes": {"action": "open", "iid": 794, "labels": [{"title": "` + config.TriggerTag + `", "project_id": null, "group_id": 7}]}}`,
+			expectedResult: true,
+			expectedProjID: 321,
+			expectedMRIID:  794,
+		},
+		{
+			name:           "MR Event with Project Label from Another Project",
+			kind:           "merge_request",
+			payload:        `{"project": {"id": 321}, "object_attributes": {"action": "open", "iid": 795, "labels": [{"title": "` + config.TriggerTag + `", "project_id": 999}]}}`,
+			expectedResult: true,
+			expectedProjID: 321,
+			expectedMRIID:  795,
+		},
+		{
+			name:           "MR Event with Target Project ID Only",
+			kind:           "merge_request",
+			payload:        `{"object_attributes": {"action": "open", "iid": 796, "target_project_id": 654, "labels": [{"title": "` + config.TriggerTag + `", "project_id": null}]}}`,
+			expectedResult: true,
+			expectedProjID: 654,
+			expectedMRIID:  796,
+		},
+		{
+			name:           "MR Description Edit on Labeled MR",
+			kind:           "merge_request",
+			payload:        `{"object_attributes": {"action": "update", "iid": 792, "labels": [{"title": "` + config.TriggerTag + `", "project_id": 321}]}, "changes": {"description": {"previous": "a", "current": "b"}}}`,
+			expectedResult: false,
+		},
+		{
+			name:           "MR Source Push on Labeled MR",
+			kind:           "merge_request",
+			payload:        `{"object_attributes": {"action": "update", "iid": 793, "oldrev": "abc123", "labels": [{"title": "` + config.TriggerTag + `", "project_id": 321}]}}`,
+			expectedResult: false,
+		},
+		{
+			name:           "Invalid Note Event",
+			kind:           "note",
+			payload:        `{"object_attributes": {"action": "create", "note": "Wrong message", "noteable_type": "MergeRequest"}}`,
 			expectedResult: false,
 		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			projID, mrIID, result := s.validateEvent(tc.event)
+			trigger, result, _ := s.validateEvent(tc.kind, []byte(tc.payload))
 			if result != tc.expectedResult {
 				t.Errorf("Expected result %v, got %v", tc.expectedResult, result)
 			}
 			if result {
-				if projID != tc.expectedProjID {
-					t.Errorf("Expected project ID %d, got %d", tc.expectedProjID, projID)
+				if trigger.projectID != tc.expectedProjID {
+					t.Errorf("Expected project ID %d, got %d", tc.expectedProjID, trigger.projectID)
 				}
-				if mrIID != tc.expectedMRIID {
-					t.Errorf("Expected merge request IID %d, got %d", tc.expectedMRIID, mrIID)
+				if trigger.mergeRequestIID != tc.expectedMRIID {
+					t.Errorf("Expected merge request IID %d, got %d", tc.expectedMRIID, trigger.mergeRequestIID)
 				}
 			}
 		})
@@ -70,22 +133,24 @@ func TestValidateEvent(t *testing.T) {
 
 func TestValidateSecretToken(t *testing.T) {
 	s := NewServer()
-	config.SecretToken = "test-secret"
 
 	testCases := []struct {
 		name          string
+		secret        string
 		token         string
 		expectedError bool
 		projectID     int
 	}{
 		{
 			name:          "Valid Secret Token",
+			secret:        "test-secret",
 			token:         "test-secret",
 			expectedError: false,
 			projectID:     123,
 		},
 		{
 			name:          "Invalid Secret Token",
+			secret:        "test-secret",
 			token:         "wrong-token",
 			expectedError: true,
 			projectID:     456,
@@ -100,6 +165,7 @@ func TestValidateSecretToken(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
+			setConfig(t, &config.SecretToken, tc.secret)
 			req, _ := http.NewRequest("POST", "/webhook", nil)
 			req.Header.Set("X-Gitlab-Token", tc.token)
 
@@ -115,9 +181,16 @@ func TestValidateSecretToken(t *testing.T) {
 }
 
 func TestHandleWebhook(t *testing.T) {
-	s := NewServer()
-	config.TriggerMessage = "combine mr"
-	config.TriggerTag = "mr-combine"
+	setConfig(t, &config.TriggerMessage, "combine mr")
+	setConfig(t, &config.TriggerTag, "mr-combine")
+	s := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v4/projects/123/members/all/7" {
+			w.Write([]byte(`{"id": 7, "username": "alice", "access_level": 30}`))
+			return
+		}
+		w.Write([]byte(`{}`))
+	})
+	s.pool = newWorkerPool(0, 0, 0, s.executeJob)
 
 	testCases := []struct {
 		name           string
@@ -131,13 +204,15 @@ func TestHandleWebhook(t *testing.T) {
 				"object_kind": "note",
 				"event_type": "note",
 				"project_id": 123,
+				"user": {"id": 7, "username": "alice"},
 				"object_attributes": {
 					"action": "create",
 					"note": "combine mr",
 					"noteable_type": "MergeRequest",
-					"noteable_id": 456,
+					"noteable_id": 9001,
 					"project_id": 123
-				}
+				},
+				"merge_request": {"iid": 456}
 			}`,
 			expectedStatus: http.StatusOK,
 			expectedBody:   `{"message":"OK"}`,
@@ -192,7 +267,7 @@ func TestIsProjectActive(t *testing.T) {
 			name:      "Project Active",
 			projectID: 456,
 			beforeTest: func(s *Server) {
-				s.activeProjects.Store(456, struct{}{})
+				s.activeProjects.Store(runKey{projectID: 456, targetBranch: "develop"}, newCombineJob(456, 1, testProfile("develop")))
 			},
 			expected: true,
 		},
@@ -211,3 +286,1180 @@ func TestIsProjectActive(t *testing.T) {
 		})
 	}
 }
+
+func TestStartMergeProcessSupersedes(t *testing.T) {
+	s := NewServer()
+
+	previous := newCombineJob(123, 1, testProfile("stage"))
+	s.activeProjects.Store(previous.key(), previous)
+
+	next := newCombineJob(123, 2, testProfile("stage"))
+	if err := s.startMergeProcess(next); err != nil {
+		t.Fatalf("Expected the run to be queued, got %v", err)
+	}
+
+	if !previous.superseded() {
+		t.Errorf("Expected the in-flight run to be superseded")
+	}
+	if next.superseded() {
+		t.Errorf("Expected the new run not to be superseded")
+	}
+
+	active, _ := s.activeProjects.Load(next.key())
+	if active != next {
+		t.Errorf("Expected the new run to own the project lock")
+	}
+}
+
+func TestWorkerPoolBackpressure(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan *combineJob, 4)
+	pool := newWorkerPool(1, 1, 0, func(job *combineJob) {
+		started <- job
+		<-release
+	})
+	defer close(release)
+
+	first := newCombineJob(1, 1, testProfile("stage"))
+	if err := pool.submit([]*combineJob{first}, nil); err != nil {
+		t.Fatalf("Expected first job to be queued, got %v", err)
+	}
+	<-started
+
+	if err := pool.submit([]*combineJob{newCombineJob(2, 1, testProfile("stage"))}, nil); err != nil {
+		t.Fatalf("Expected second job to be queued, got %v", err)
+	}
+	if err := pool.submit([]*combineJob{newCombineJob(3, 1, testProfile("stage"))}, nil); err != errQueueFull {
+		t.Errorf("Expected errQueueFull, got %v", err)
+	}
+}
+
+func TestWorkerPoolQueuesAllOrNothing(t *testing.T) {
+	pool := newWorkerPool(0, 2, 0, func(job *combineJob) {})
+
+	accepted := 0
+	jobs := []*combineJob{
+		newCombineJob(1, 1, testProfile("stage")),
+		newCombineJob(1, 1, testProfile("qa")),
+		newCombineJob(1, 1, testProfile("prod")),
+	}
+	if err := pool.submit(jobs, func(*combineJob) bool { accepted++; return true }); err != errQueueFull {
+		t.Errorf("Expected errQueueFull, got %v", err)
+	}
+	if accepted != 0 || len(pool.pending) != 0 {
+		t.Errorf("Expected no job to be queued, got %d accepted and %d pending", accepted, len(pool.pending))
+	}
+
+	if err := pool.submit(jobs[:2], func(*combineJob) bool { accepted++; return true }); err != nil {
+		t.Fatalf("Expected both jobs to be queued, got %v", err)
+	}
+	if accepted != 2 || len(pool.pending) != 2 {
+		t.Errorf("Expected 2 queued jobs, got %d accepted and %d pending", accepted, len(pool.pending))
+	}
+}
+
+func TestWorkerPoolNamespaceLimit(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan *combineJob, 4)
+	pool := newWorkerPool(2, 0, 1, func(job *combineJob) {
+		started <- job
+		<-release
+	})
+	defer close(release)
+
+	busy := []*combineJob{newCombineJob(1, 1, testProfile("stage")), newCombineJob(2, 1, testProfile("stage"))}
+	for _, job := range busy {
+		job.namespace = "group-a"
+	}
+	other := newCombineJob(3, 1, testProfile("stage"))
+	other.namespace = "group-b"
+
+	for _, job := range append(busy, other) {
+		if err := pool.submit([]*combineJob{job}, nil); err != nil {
+			t.Fatalf("Expected job to be queued, got %v", err)
+		}
+	}
+
+	if job := <-started; job != busy[0] {
+		t.Errorf("Expected the first group-a job to start first")
+	}
+	if job := <-started; job != other {
+		t.Errorf("Expected the group-b job to overtake the second group-a job")
+	}
+}
+
+func TestRecoverJobReportsInternalError(t *testing.T) {
+	var noteBody string
+	s := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		noteBody = string(data)
+		w.Write([]byte(`{}`))
+	})
+
+	job := newCombineJob(123, 7, testProfile("stage"))
+	func() {
+		defer s.recoverJob(job)
+		panic("boom")
+	}()
+
+	if job.State() != jobFailed {
+		t.Errorf("Expected job state %q, got %q", jobFailed, job.State())
+	}
+	if !strings.Contains(noteBody, job.id) {
+		t.Errorf("Expected the MR comment to mention run %s, got %s", job.id, noteBody)
+	}
+}
+
+func TestRecoverCommandRepliesWithInternalError(t *testing.T) {
+	var noteBody string
+	s := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		noteBody = string(data)
+		w.Write([]byte(`{}`))
+	})
+
+	trigger := combineTrigger{projectID: 123, mergeRequestIID: 7, command: &noteCommand{name: commandStatus}}
+	func() {
+		defer s.recoverCommand(trigger)
+		panic("boom")
+	}()
+
+	if !strings.Contains(noteBody, "Internal error") {
+		t.Errorf("Expected the command reply to report an internal error, got %s", noteBody)
+	}
+}
+
+// setConfig overrides a configuration variable for the duration of a test.
+func setConfig[T any](t *testing.T, variable *T, value T) {
+	previous := *variable
+	*variable = value
+	t.Cleanup(func() { *variable = previous })
+}
+
+// newTestServer starts a fake GitLab answering with handler and returns a
+// server whose API client talks to it.
+func newTestServer(t *testing.T, handler http.HandlerFunc) *Server {
+	gitlabServer := httptest.NewServer(handler)
+	t.Cleanup(gitlabServer.Close)
+	setConfig(t, &config.GitlabURL, gitlabServer.URL)
+
+	s := NewServer()
+	s.apiClient = gitlab.NewApiClient()
+	return s
+}
+
+// setProfiles loads profiles from profilesJSON and reloads the previous ones
+// once the test is done.
+func setProfiles(t *testing.T, profilesJSON string) {
+	t.Cleanup(func() { config.LoadProfiles() })
+	setConfig(t, &config.ProfilesJSON, profilesJSON)
+	if err := config.LoadProfiles(); err != nil {
+		t.Fatalf("Expected profiles to load, got %v", err)
+	}
+}
+
+func TestScheduledRunYieldsToRunningJob(t *testing.T) {
+	s := NewServer()
+	s.pool = newWorkerPool(0, 0, 0, s.executeJob)
+
+	explicit := newCombineJob(1, 7, testProfile("stage"))
+	if err := s.startMergeProcess(explicit); err != nil {
+		t.Fatalf("Expected the explicit run to be queued, got %v", err)
+	}
+
+	scheduled := newCombineJob(1, 0, testProfile("stage"))
+	scheduled.skipUnchanged = true
+	if err := s.startMergeProcess(scheduled); err != errRunning {
+		t.Errorf("Expected errRunning, got %v", err)
+	}
+	if explicit.interrupted() {
+		t.Errorf("Expected the explicit run to keep running, got %v", context.Cause(explicit.ctx))
+	}
+	if len(s.pool.pending) != 1 {
+		t.Errorf("Expected only the explicit run to be queued, got %d jobs", len(s.pool.pending))
+	}
+
+	newer := newCombineJob(1, 8, testProfile("stage"))
+	if err := s.startMergeProcess(newer); err != nil {
+		t.Fatalf("Expected the newer run to be queued, got %v", err)
+	}
+	if !explicit.superseded() {
+		t.Errorf("Expected a newer explicit run to supersede the old one")
+	}
+}
+
+func TestFireScheduleUsesProjectNamespace(t *testing.T) {
+	s := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v4/projects/5" {
+			t.Errorf("Unexpected GitLab request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"id": 5, "path_with_namespace": "group/sub/app"}`))
+	})
+	s.pool = newWorkerPool(0, 0, 0, s.executeJob)
+
+	profile := testProfile("stage")
+	profile.Projects = []int{5}
+	s.fireSchedule(profile, time.Now())
+
+	if len(s.pool.pending) != 1 {
+		t.Fatalf("Expected the scheduled run to be queued, got %d jobs", len(s.pool.pending))
+	}
+	if namespace := s.pool.pending[0].namespace; namespace != "group/sub" {
+		t.Errorf("Expected the run to count against namespace group/sub, got %q", namespace)
+	}
+}
+
+func TestClaimScheduleAcrossReplicas(t *testing.T) {
+	dir := t.TempDir()
+	first, second := NewServer(), NewServer()
+	first.locker = &lock.FileLocker{Dir: dir}
+	second.locker = &lock.FileLocker{Dir: dir}
+	repoInfo := &gitlab.RepoInfo{RepoURL: "git@gitlab.example.com:group/app.git"}
+
+	job := newCombineJob(1, 0, testProfile("stage"))
+	if err := first.claimSchedule(context.Background(), job, repoInfo); err != nil {
+		t.Fatalf("Expected the first replica to claim the schedule, got %v", err)
+	}
+	if err := second.claimSchedule(context.Background(), job, repoInfo); err != errScheduled {
+		t.Errorf("Expected the second replica to skip, got %v", err)
+	}
+	if err := first.claimSchedule(context.Background(), job, repoInfo); err != nil {
+		t.Errorf("Expected the first replica to renew its claim, got %v", err)
+	}
+
+	lease, err := first.locker.TryAcquire(context.Background(), lock.Key{ProjectID: 1, Branch: "stage"})
+	if err != nil {
+		t.Fatalf("Expected the schedule claim to leave the combine lock free, got %v", err)
+	}
+	lease.Release(context.Background())
+}
+
+func testProfile(targetBranch string) config.Profile {
+	return config.Profile{Name: targetBranch, Label: "combine-" + targetBranch, TargetBranch: targetBranch}
+}
+
+func TestMergeRequestLifecycleTriggersProfiles(t *testing.T) {
+	setProfiles(t, `[
+		{"name": "stage", "label": "stage-mr", "target_branch": "stage"},
+		{"name": "qa", "label": "qa-mr", "target_branch": "qa"}
+	]`)
+
+	s := NewServer()
+
+	testCases := []struct {
+		name             string
+		action           string
+		labels           string
+		expectedProfiles []string
+		expectedNote     string
+	}{
+		{
+			name:             "Merged MR in Both Profiles",
+			action:           "merge",
+			labels:           `[{"title": "stage-mr", "project_id": 5}, {"title": "qa-mr", "project_id": 5}]`,
+			expectedProfiles: []string{"stage", "qa"},
+			expectedNote:     "MR #12 was merged and is removed from stage",
+		},
+		{
+			name:             "Closed MR in One Profile",
+			action:           "close",
+			labels:           `[{"title": "qa-mr", "project_id": 5}]`,
+			expectedProfiles: []string{"qa"},
+			expectedNote:     "MR #12 was closed and is removed from qa",
+		},
+		{
+			name:             "Reopened MR",
+			action:           "reopen",
+			labels:           `[{"title": "stage-mr", "project_id": 5}]`,
+			expectedProfiles: []string{"stage"},
+			expectedNote:     "MR #12 was reopened and is re-added to stage",
+		},
+		{
+			name:   "Closed MR without Labels",
+			action: "close",
+			labels: `[]`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			trigger, ok, _ := s.validateEvent("merge_request", []byte(`{"object_attributes": {"action": "`+tc.action+`", "iid": 12, "labels": `+tc.labels+`}}`))
+			if ok != (len(tc.expectedProfiles) > 0) {
+				t.Fatalf("Expected result %v, got %v", len(tc.expectedProfiles) > 0, ok)
+			}
+
+			var names []string
+			for _, profile := range trigger.profiles {
+				names = append(names, profile.Name)
+			}
+			if strings.Join(names, ",") != strings.Join(tc.expectedProfiles, ",") {
+				t.Errorf("Expected profiles %v, got %v", tc.expectedProfiles, names)
+			}
+
+			if !ok {
+				return
+			}
+			if note := membershipNote(trigger.action, trigger.mergeRequestIID, trigger.profiles[0].TargetBranch); note != tc.expectedNote {
+				t.Errorf("Expected note %q, got %q", tc.expectedNote, note)
+			}
+		})
+	}
+}
+
+func TestMergeRequestRefreshIsPerProfile(t *testing.T) {
+	setProfiles(t, `[
+		{"name": "stage", "label": "stage-mr", "target_branch": "stage"},
+		{"name": "qa", "label": "qa-mr", "target_branch": "qa"}
+	]`)
+	setConfig(t, &config.TriggerOnSourcePush, true)
+
+	s := NewServer()
+	payload := `{"project": {"id": 5}, "object_attributes": {"action": "update", "iid": 12, "oldrev": "abc123", "labels": [{"title": "stage-mr"}, {"title": "qa-mr"}]},
+		"changes": {"labels": {"previous": [{"title": "qa-mr"}], "current": [{"title": "stage-mr"}, {"title": "qa-mr"}]}}}`
+
+	trigger, ok, err := s.validateEvent("merge_request", []byte(payload))
+	if err != nil || !ok || len(trigger.profiles) != 2 {
+		t.Fatalf("Expected both profiles to be triggered, got %+v, %v", trigger, err)
+	}
+	if trigger.refreshes(trigger.profiles[0]) {
+		t.Error("Expected the label change of stage to rebuild right away")
+	}
+	if !trigger.refreshes(trigger.profiles[1]) {
+		t.Error("Expected the source push of qa to be debounced")
+	}
+}
+
+func TestValidatePushEvent(t *testing.T) {
+	setConfig(t, &config.TriggerOnDefaultBranchPush, true)
+	s := NewServer()
+
+	testCases := []struct {
+		name           string
+		ref            string
+		after          string
+		expectedResult bool
+	}{
+		{
+			name:           "Push to Default Branch",
+			ref:            "refs/heads/main",
+			after:          "d1a2b3",
+			expectedResult: true,
+		},
+		{
+			name:           "Push to Combined Branch",
+			ref:            "refs/heads/" + config.TargetBranch,
+			after:          "d1a2b3",
+			expectedResult: false,
+		},
+		{
+			name:           "Push to Feature Branch",
+			ref:            "refs/heads/feature",
+			after:          "d1a2b3",
+			expectedResult: false,
+		},
+		{
+			name:           "Default Branch Deleted",
+			ref:            "refs/heads/main",
+			after:          "0000000000000000000000000000000000000000",
+			expectedResult: false,
+		},
+		{
+			name:           "Tag Push",
+			ref:            "refs/tags/v1.0.0",
+			after:          "d1a2b3",
+			expectedResult: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			payload := `{"object_kind": "push", "project_id": 42, "ref": "` + tc.ref + `", "after": "` + tc.after + `", "project": {"default_branch": "main"}}`
+
+			trigger, result, _ := s.validateEvent("push", []byte(payload))
+			if result != tc.expectedResult {
+				t.Fatalf("Expected result %v, got %v", tc.expectedResult, result)
+			}
+			if result && (trigger.projectID != 42 || !trigger.refreshes(trigger.profiles[0])) {
+				t.Errorf("Expected a refresh of project 42, got %+v", trigger)
+			}
+		})
+	}
+}
+
+func TestRefreshSkipsProfileWithoutBranch(t *testing.T) {
+	setConfig(t, &config.WorkDir, t.TempDir())
+	s := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v4/projects/5":
+			w.Write([]byte(`{"id": 5, "path_with_namespace": "group/app", "default_branch": "main"}`))
+		case "/api/graphql":
+			w.Write([]byte(`{"errors": [{"message": "Field 'approved' doesn't exist on type 'MergeRequest'"}]}`))
+		case "/api/v4/projects/5/merge_requests":
+			w.Write([]byte(`[]`))
+		case "/api/v4/projects/5/repository/branches/main":
+			w.Write([]byte(`{"name": "main", "commit": {"id": "abc"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message": "404 Branch Not Found"}`))
+		}
+	})
+
+	job := newCombineJob(5, 0, testProfile("develop"))
+	job.refresh = true
+	if _, err := s.combineAllMRs(job); err != errNoBranch {
+		t.Fatalf("Expected errNoBranch, got %v", err)
+	}
+	if entries, _ := os.ReadDir(config.WorkDir); len(entries) != 0 {
+		t.Errorf("Expected nothing to be cloned, found %d entries", len(entries))
+	}
+}
+
+func TestHandleWebhookDeduplicatesDeliveries(t *testing.T) {
+	s := NewServer()
+
+	deliver := func(uuid, body string) string {
+		req, _ := http.NewRequest("POST", "/webhook", bytes.NewBufferString(body))
+		req.Header.Set("X-Gitlab-Event-UUID", uuid)
+		w := httptest.NewRecorder()
+		s.handleWebhook(w, req)
+		return strings.TrimSpace(w.Body.String())
+	}
+
+	ignored := `{"event_type": "note", "object_attributes": {"action": "create", "note": "unrelated", "noteable_type": "MergeRequest"}}`
+	if body := deliver("uuid-1", ignored); body != `{"message":"Event ignored"}` {
+		t.Fatalf("Expected the first delivery to be handled, got %s", body)
+	}
+	if body := deliver("uuid-1", ignored); body != `{"message":"Duplicate event ignored"}` {
+		t.Errorf("Expected the redelivery to be acknowledged as duplicate, got %s", body)
+	}
+
+	if body := deliver("uuid-2", `{`); body != `{"error":"Invalid request body"}` {
+		t.Fatalf("Expected the broken delivery to fail, got %s", body)
+	}
+	if body := deliver("uuid-2", ignored); body != `{"message":"Event ignored"}` {
+		t.Errorf("Expected a retry of a failed delivery to be handled, got %s", body)
+	}
+
+	redeliver := func() string {
+		req, _ := http.NewRequest("POST", "/webhook", bytes.NewBufferString(ignored))
+		req.Header.Set("X-GitHub-Delivery", "delivery-1")
+		w := httptest.NewRecorder()
+		s.handleWebhook(w, req)
+		return strings.TrimSpace(w.Body.String())
+	}
+	redeliver()
+	if body := redeliver(); body != `{"message":"Duplicate event ignored"}` {
+		t.Errorf("Expected a GitHub redelivery to be acknowledged as duplicate, got %s", body)
+	}
+}
+
+func TestEventCacheBounds(t *testing.T) {
+	cache := newEventCache(time.Minute, 2)
+	now := time.Now()
+
+	for _, key := range []string{"a", "b", "c"} {
+		if !cache.add([]string{key}, now) {
+			t.Fatalf("Expected %s to be new", key)
+		}
+	}
+	if !cache.add([]string{"a"}, now) {
+		t.Errorf("Expected the oldest entry to have been evicted")
+	}
+	if cache.add([]string{"c"}, now) {
+		t.Errorf("Expected c to still be cached")
+	}
+	if !cache.add([]string{"c"}, now.Add(2*time.Minute)) {
+		t.Errorf("Expected c to expire after the TTL")
+	}
+}
+
+func TestHandleWebhookRouting(t *testing.T) {
+	s := NewServer()
+
+	testCases := []struct {
+		name         string
+		header       string
+		eventJSON    string
+		expectedBody string
+	}{
+		{
+			name:         "Routed by Header",
+			header:       "Note Hook",
+			eventJSON:    `{"object_attributes": {"action": "create", "note": "unrelated", "noteable_type": "MergeRequest"}}`,
+			expectedBody: `{"message":"Event ignored"}`,
+		},
+		{
+			name:         "Unknown Event by Header",
+			header:       "Pipeline Hook",
+			eventJSON:    `{"object_kind": "pipeline"}`,
+			expectedBody: `{"message":"Unsupported event: pipeline"}`,
+		},
+		{
+			name:         "Unknown Event by Object Kind",
+			eventJSON:    `{"object_kind": "build"}`,
+			expectedBody: `{"message":"Unsupported event: build"}`,
+		},
+		{
+			name:         "Arbitrary Object Kind",
+			eventJSON:    `{"object_kind": "made-up-kind-42"}`,
+			expectedBody: `{"message":"Unsupported event: made-up-kind-42"}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/webhook", bytes.NewBufferString(tc.eventJSON))
+			if tc.header != "" {
+				req.Header.Set("X-Gitlab-Event", tc.header)
+			}
+			w := httptest.NewRecorder()
+
+			s.handleWebhook(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+			}
+			if body := strings.TrimSpace(w.Body.String()); body != tc.expectedBody {
+				t.Errorf("Expected body %s, got %s", tc.expectedBody, body)
+			}
+		})
+	}
+
+	if count := unknownEvents.Value("pipeline"); count < 1 {
+		t.Errorf("Expected unknown pipeline events to be counted, got %v", count)
+	}
+	if unknownEvents.Value("made-up-kind-42") != 0 || unknownEvents.Value("other") < 1 {
+		t.Error("Expected arbitrary event kinds to be counted as other")
+	}
+}
+
+func TestSystemHookResolvesProjectByPath(t *testing.T) {
+	var requestedPath string
+	s := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		requestedPath = r.URL.EscapedPath()
+		w.Write([]byte(`{"id": 42, "path_with_namespace": "group/app", "default_branch": "main"}`))
+	})
+
+	payload := `{
+		"object_kind": "merge_request",
+		"event_type": "merge_request",
+		"project": {"name": "app", "path_with_namespace": "group/app"},
+		"object_attributes": {"action": "open", "iid": 5},
+		"labels": [{"title": "test-tag", "project_id": null}]
+	}`
+	req, _ := http.NewRequest("POST", "/webhook", nil)
+	req.Header.Set("X-Gitlab-Event", "System Hook")
+
+	kind := eventKind(req, []byte(payload))
+	if kind != eventTypeMergeRequest {
+		t.Fatalf("Expected system hook to route to %q, got %q", eventTypeMergeRequest, kind)
+	}
+
+	setConfig(t, &config.TriggerTag, "test-tag")
+	trigger, ok, err := s.validateEvent(kind, []byte(payload))
+	if err != nil || !ok {
+		t.Fatalf("Expected system hook MR event to trigger, got %v, %v", ok, err)
+	}
+	if err := s.resolveProject(context.Background(), &trigger); err != nil {
+		t.Fatalf("Expected project to resolve, got %v", err)
+	}
+
+	if requestedPath != "/api/v4/projects/group%2Fapp" {
+		t.Errorf("Expected lookup by encoded path, got %s", requestedPath)
+	}
+	if trigger.projectID != 42 || trigger.namespace != "group" {
+		t.Errorf("Expected project 42 in namespace group, got %d in %s", trigger.projectID, trigger.namespace)
+	}
+}
+
+func TestProjectAllowlist(t *testing.T) {
+	setConfig(t, &config.ProjectAllowlist, []string{"17", "Group/App"})
+
+	testCases := []struct {
+		projectID int
+		path      string
+		expected  bool
+	}{
+		{projectID: 17, expected: true},
+		{projectID: 42, path: "group/app", expected: true},
+		{projectID: 43, path: "group/other", expected: false},
+	}
+
+	for _, tc := range testCases {
+		if allowed := config.ProjectAllowed(tc.projectID, tc.path); allowed != tc.expected {
+			t.Errorf("ProjectAllowed(%d, %q) = %t, expected %t", tc.projectID, tc.path, allowed, tc.expected)
+		}
+	}
+
+	s := NewServer()
+	setConfig(t, &config.TriggerTag, "test-tag")
+	setConfig(t, &config.SecretToken, "")
+	payload := `{
+		"object_kind": "merge_request",
+		"project": {"id": 43, "path_with_namespace": "group/other"},
+		"object_attributes": {"action": "open", "iid": 5},
+		"labels": [{"title": "test-tag", "project_id": 43}]
+	}`
+	req, _ := http.NewRequest("POST", "/webhook", bytes.NewBufferString(payload))
+	req.Header.Set("X-Gitlab-Event", "System Hook")
+	w := httptest.NewRecorder()
+
+	s.handleWebhook(w, req)
+
+	if body := strings.TrimSpace(w.Body.String()); body != `{"message":"Event ignored"}` {
+		t.Errorf("Expected project outside the allowlist to be ignored, got %s", body)
+	}
+	if s.isProjectActive(43) {
+		t.Error("Expected no combine to start for a project outside the allowlist")
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	testCases := []struct {
+		note     string
+		expected noteCommand
+		ok       bool
+	}{
+		{note: "/combine status", expected: noteCommand{name: "status"}, ok: true},
+		{note: "/combine exclude !12", expected: noteCommand{name: "exclude", mergeRequestIID: 12}, ok: true},
+		{note: "/combine include 7 stage", expected: noteCommand{name: "include", mergeRequestIID: 7, profile: "stage"}, ok: true},
+		{note: "/combine", ok: false},
+		{note: "please /combine status", ok: false},
+	}
+
+	for _, tc := range testCases {
+		command, ok := parseCommand(tc.note)
+		if ok != tc.ok || command != tc.expected {
+			t.Errorf("parseCommand(%q) = %+v, %v, expected %+v, %v", tc.note, command, ok, tc.expected, tc.ok)
+		}
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	var requests []string
+	s := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+string(data))
+		w.Write([]byte(`{}`))
+	})
+	profile := testProfile("stage")
+
+	running := newCombineJob(5, 1, profile)
+	running.setState(jobRunning)
+	s.activeProjects.Store(running.key(), running)
+
+	finished := newCombineJob(5, 1, profile)
+	finished.setState(jobSucceeded)
+	s.lastRuns.Store(finished.key(), finished)
+
+	testCases := []struct {
+		command  noteCommand
+		expected string
+	}{
+		{command: noteCommand{name: commandStatus}, expected: "run " + running.id + " is running, last run " + finished.id + " succeeded"},
+		{command: noteCommand{name: commandInclude, mergeRequestIID: 12}, expected: "Added combine-stage to !12"},
+		{command: noteCommand{name: commandExclude}, expected: "missing merge request"},
+		{command: noteCommand{name: commandCancel}, expected: "cancelling run " + running.id},
+		{command: noteCommand{name: "frobnicate"}, expected: "unknown command"},
+	}
+
+	for _, tc := range testCases {
+		requests = nil
+		command := tc.command
+		s.runCommand(combineTrigger{projectID: 5, mergeRequestIID: 3, profiles: []config.Profile{profile}, command: &command})
+
+		reply := requests[len(requests)-1]
+		if !strings.HasPrefix(reply, "POST /api/v4/projects/5/merge_requests/3/notes") || !strings.Contains(reply, tc.expected) {
+			t.Errorf("Expected reply to %s to contain %q, got %s", command.name, tc.expected, reply)
+		}
+		if command.name == commandInclude && !strings.Contains(requests[0], `PUT /api/v4/projects/5/merge_requests/12 {"add_labels":"combine-stage"}`) {
+			t.Errorf("Expected the label to be added through the API, got %s", requests[0])
+		}
+	}
+
+	if !running.cancelled() {
+		t.Error("Expected the running job to be cancelled")
+	}
+}
+
+func TestAuthorizeTrigger(t *testing.T) {
+	var notes []string
+	setConfig(t, &config.AllowedUsers, []string{"release-bot"})
+	setConfig(t, &config.AllowedGroups, []string{"platform/leads"})
+
+	s := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/api/v4/projects/5/members/all/1":
+			w.Write([]byte(`{"access_level": 30}`))
+		case "/api/v4/projects/5/members/all/2":
+			w.Write([]byte(`{"access_level": 20}`))
+		case "/api/v4/groups/platform%2Fleads/members/all/3":
+			w.Write([]byte(`{"access_level": 10}`))
+		case "/api/v4/projects/5/merge_requests/9/notes":
+			data, _ := io.ReadAll(r.Body)
+			notes = append(notes, string(data))
+			w.Write([]byte(`{}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message": "404 Not found"}`))
+		}
+	})
+	var auditLog bytes.Buffer
+	s.audit = log.New()
+	s.audit.SetOutput(&auditLog)
+	s.audit.SetFormatter(&log.JSONFormatter{})
+
+	testCases := []struct {
+		name     string
+		user     EventUser
+		expected bool
+	}{
+		{name: "Developer", user: EventUser{ID: 1, Username: "dev"}, expected: true},
+		{name: "Reporter", user: EventUser{ID: 2, Username: "reporter"}, expected: false},
+		{name: "Allowed Group Member", user: EventUser{ID: 3, Username: "lead"}, expected: true},
+		{name: "Allowed User", user: EventUser{ID: 4, Username: "release-bot"}, expected: true},
+		{name: "Not a Member", user: EventUser{ID: 5, Username: "guest"}, expected: false},
+		{name: "No User", expected: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			notes, auditLog = nil, bytes.Buffer{}
+			trigger := combineTrigger{projectID: 5, mergeRequestIID: 9, fromNote: true, user: tc.user, profiles: []config.Profile{testProfile("stage")}}
+
+			if allowed := s.authorizeTrigger(context.Background(), trigger); allowed != tc.expected {
+				t.Errorf("Expected allowed=%v, got %v", tc.expected, allowed)
+			}
+
+			decision := `"decision":"allow"`
+			if !tc.expected {
+				decision = `"decision":"deny"`
+			}
+			if !strings.Contains(auditLog.String(), decision) || !strings.Contains(auditLog.String(), tc.user.Username) {
+				t.Errorf("Expected audit record with %s for %s, got %s", decision, tc.user.Username, auditLog.String())
+			}
+
+			if tc.expected != (len(notes) == 0) {
+				t.Errorf("Expected a refusal reply only for denied triggers, got %v", notes)
+			}
+			if !tc.expected && (!strings.Contains(notes[0], "Sorry") || !strings.Contains(notes[0], tc.user.Username)) {
+				t.Errorf("Expected a polite refusal, got %s", notes[0])
+			}
+		})
+	}
+
+	notes = nil
+	if !s.authorizeTrigger(context.Background(), combineTrigger{projectID: 5, mergeRequestIID: 9, profiles: []config.Profile{testProfile("stage")}}) || len(notes) > 0 {
+		t.Error("Expected label and push triggers to need no membership check")
+	}
+}
+
+func TestProcessSingleMergeRequestMergesListedSHA(t *testing.T) {
+	dir := t.TempDir()
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@localhost", "-C", dir}, args...)...)
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v, output: %s", args, err, output)
+		}
+		return strings.TrimSpace(string(output))
+	}
+
+	git("init", "--quiet", "--bare", "origin.git")
+	git("init", "--quiet", "-b", "main", "work")
+	work := func(args ...string) string { return git(append([]string{"-C", "work"}, args...)...) }
+	work("commit", "--quiet", "--allow-empty", "-m", "base")
+	work("push", "--quiet", "../origin.git", "main", "main:stage")
+	work("commit", "--quiet", "--allow-empty", "-m", "listed")
+	listed := work("rev-parse", "HEAD")
+	work("commit", "--quiet", "--allow-empty", "-m", "pushed after listing")
+	work("push", "--quiet", "../origin.git", "HEAD:refs/merge-requests/1/head")
+	git("clone", "--quiet", "-b", "stage", "origin.git", "clone")
+	git("-C", "clone", "config", "user.name", "test")
+	git("-C", "clone", "config", "user.email", "test@localhost")
+
+	s := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"iid": 1, "head_pipeline": {"id": 9, "status": "success"}}`))
+	})
+	job := newCombineJob(5, 1, testProfile("stage"))
+	mr := gitlab.MergeRequest{IID: 1, Title: "Feature", SHA: listed, SourceBranch: "feature", Author: gitlab.User{Username: "alice"}, Draft: true}
+
+	if err := s.processSingleMergeRequest(context.Background(), filepath.Join(dir, "clone"), mr, job); err != nil {
+		t.Fatalf("Expected the merge to succeed, got %v", err)
+	}
+
+	clone := func(args ...string) string { return git(append([]string{"-C", "clone"}, args...)...) }
+	if parent := clone("rev-parse", "HEAD^2"); parent != listed {
+		t.Errorf("Expected the listed SHA %s to be merged, got %s", listed, parent)
+	}
+	if subject := clone("log", "-1", "--format=%s"); subject != "Merge branch 'feature' into stage (!1)" {
+		t.Errorf("Unexpected merge commit subject %q", subject)
+	}
+
+	report := strings.Join(job.comments, "\n")
+	for _, detail := range []string{"feature@" + listed[:8], "by @alice", "draft", "pipeline success"} {
+		if !strings.Contains(report, detail) {
+			t.Errorf("Expected report to contain %q, got %s", detail, report)
+		}
+	}
+}
+
+func TestProcessSingleMergeRequestVerifiesListedSHA(t *testing.T) {
+	dir := t.TempDir()
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@localhost", "-C", dir}, args...)...)
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v, output: %s", args, err, output)
+		}
+		return strings.TrimSpace(string(output))
+	}
+
+	git("init", "--quiet", "--bare", "origin.git")
+	git("init", "--quiet", "-b", "main", "work")
+	work := func(args ...string) string { return git(append([]string{"-C", "work"}, args...)...) }
+	work("commit", "--quiet", "--allow-empty", "-m", "base")
+	work("push", "--quiet", "../origin.git", "main", "main:stage")
+	work("commit", "--quiet", "--allow-empty", "-m", "listed before the force push")
+	forcePushed := work("rev-parse", "HEAD")
+	work("push", "--quiet", "../origin.git", "HEAD:other")
+	work("reset", "--quiet", "--hard", "HEAD^")
+	work("commit", "--quiet", "--allow-empty", "-m", "after the force push")
+	work("push", "--quiet", "../origin.git", "HEAD:refs/merge-requests/1/head")
+	git("clone", "--quiet", "-b", "stage", "origin.git", "clone")
+
+	tests := []struct {
+		name     string
+		sha      string
+		expected string
+	}{
+		{name: "Force Pushed", sha: forcePushed, expected: "listed commit " + forcePushed[:8] + " is no longer part of the MR"},
+		{name: "Unknown Commit", sha: strings.Repeat("0", 40), expected: "Error verifying MR #1: exit status 128, output: fatal:"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer()
+			job := newCombineJob(5, 1, testProfile("stage"))
+			mr := gitlab.MergeRequest{IID: 1, SHA: tt.sha, SourceBranch: "feature"}
+
+			err := s.processSingleMergeRequest(context.Background(), filepath.Join(dir, "clone"), mr, job)
+			if err == nil || !strings.Contains(err.Error(), tt.expected) {
+				t.Errorf("Expected error containing %q, got %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+func TestDiscoverMergeRequestsFallsBackToREST(t *testing.T) {
+	var requests []string
+	s := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if r.URL.Path == "/api/graphql" {
+			w.Write([]byte(`{"errors": [{"message": "Field 'approved' doesn't exist on type 'MergeRequest'"}]}`))
+			return
+		}
+		w.Write([]byte(`[{"iid": 4, "sha": "def456"}]`))
+	})
+
+	for i := 0; i < 2; i++ {
+		mergeRequests, err := s.discoverMergeRequests(context.Background(), 5, "group/app", "combine")
+		if err != nil || len(mergeRequests) != 1 || mergeRequests[0].IID != 4 {
+			t.Fatalf("Expected the REST list, got %+v, %v", mergeRequests, err)
+		}
+	}
+
+	expected := "POST /api/graphql,GET /api/v4/projects/5/merge_requests,GET /api/v4/projects/5/merge_requests"
+	if strings.Join(requests, ",") != expected {
+		t.Errorf("Expected GraphQL to be tried once, got %v", requests)
+	}
+}
+
+func TestCheckToken(t *testing.T) {
+	var response string
+	var status int
+	setConfig(t, &config.TokenExpiryWarningDays, 14)
+	setConfig(t, &config.APIMaxRetries, 0)
+	s := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v4/personal_access_tokens/self" {
+			t.Errorf("Unexpected request %s", r.URL.Path)
+		}
+		if status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+		w.Write([]byte(response))
+	})
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name     string
+		response string
+		status   int
+		problem  string
+		warning  string
+	}{
+		{name: "valid", response: `{"name": "combiner", "scopes": ["api"], "expires_at": "2025-06-01", "active": true}`},
+		{name: "expiring soon", response: `{"scopes": ["api"], "expires_at": "2025-03-08", "active": true}`, warning: "expires on 2025-03-08, in 6 days"},
+		{name: "expired", response: `{"scopes": ["api"], "expires_at": "2025-03-01", "active": false}`, problem: "expired on 2025-03-01"},
+		{name: "read only", response: `{"scopes": ["read_api", "read_repository"], "active": true}`, problem: "lacks the api scope, it has read_api, read_repository"},
+		{name: "unsupported", status: http.StatusNotFound, warning: "not supported"},
+		{name: "revoked", status: http.StatusUnauthorized, problem: "GITLAB_TOKEN is invalid"},
+		{name: "gitlab unavailable", status: http.StatusBadGateway, warning: "retrying in 1m0s"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			response, status = tc.response, tc.status
+			result := s.checkToken(context.Background(), now)
+
+			problems, warnings := strings.Join(result.Problems, "; "), strings.Join(result.Warnings, "; ")
+			if (tc.problem == "") != (problems == "") || !strings.Contains(problems, tc.problem) {
+				t.Errorf("Expected problem %q, got %q", tc.problem, problems)
+			}
+			if (tc.warning == "") != (warnings == "") || !strings.Contains(warnings, tc.warning) {
+				t.Errorf("Expected warning %q, got %q", tc.warning, warnings)
+			}
+
+			s.tokenStatus.Store(result)
+			w := httptest.NewRecorder()
+			s.handleHealth(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+			if expected := map[bool]int{true: http.StatusOK, false: http.StatusServiceUnavailable}[tc.problem == ""]; w.Code != expected {
+				t.Errorf("Expected /healthz to return %d, got %d: %s", expected, w.Code, w.Body.String())
+			}
+			if strings.Contains(w.Body.String(), "scopes") || strings.Contains(w.Body.String(), "expire") {
+				t.Errorf("Expected /healthz to hide the token details, got %s", w.Body.String())
+			}
+		})
+	}
+
+	response, status = `{"scopes": ["api"], "expires_at": "2020-01-01", "active": true}`, 0
+	s.tokenStatus.Store(nil)
+	s.refreshTokenStatus()
+	status = http.StatusBadGateway
+	if result := s.refreshTokenStatus(); result.healthy() || !result.transient {
+		t.Errorf("Expected a failed re-check to keep the expired verdict, got %+v", result)
+	}
+}
+
+func TestHealthIsUnknownUntilFirstTokenCheck(t *testing.T) {
+	release := make(chan struct{})
+	s := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte(`{"scopes": ["api"], "active": true}`))
+	})
+
+	health := func() string {
+		w := httptest.NewRecorder()
+		s.handleHealth(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		return w.Body.String()
+	}
+
+	s.startTokenCheck()
+	if body := health(); !strings.Contains(body, "unknown") {
+		t.Errorf("Expected /healthz to report unknown while the first check runs, got %s", body)
+	}
+
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for !s.tokenStatus.Load().checked() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if body := health(); !strings.Contains(body, `"ok"`) {
+		t.Errorf("Expected /healthz to report ok after the check, got %s", body)
+	}
+}
+
+func TestGitHubWebhook(t *testing.T) {
+	setProfiles(t, `[{"name": "stage", "label": "stage-pr", "target_branch": "stage"}]`)
+	setConfig(t, &config.SecretToken, "hook-secret")
+	setConfig(t, &config.TriggerOnDefaultBranchPush, true)
+
+	s := NewServer()
+	p := githubProvider{s: s}
+	repository := `"repository": {"id": 77, "full_name": "org/app", "default_branch": "main"}`
+
+	testCases := []struct {
+		name     string
+		event    string
+		payload  string
+		expected bool
+		refresh  bool
+		action   string
+	}{
+		{name: "Label Added", event: "pull_request", payload: `{"action": "labeled", "label": {"name": "stage-pr"}, "pull_request": {"number": 3, "labels": [{"name": "stage-pr"}]}, ` + repository + `}`, expected: true, action: actionUpdate},
+		{name: "Label Removed", event: "pull_request", payload: `{"action": "unlabeled", "label": {"name": "stage-pr"}, "pull_request": {"number": 3, "labels": []}, ` + repository + `}`, expected: true, action: actionUpdate},
+		{name: "Other Label Added", event: "pull_request", payload: `{"action": "labeled", "label": {"name": "bug"}, "pull_request": {"number": 3, "labels": [{"name": "bug"}, {"name": "stage-pr"}]}, ` + repository + `}`},
+		{name: "Labeled PR Merged", event: "pull_request", payload: `{"action": "closed", "pull_request": {"number": 3, "merged": true, "labels": [{"name": "stage-pr"}]}, ` + repository + `}`, expected: true, action: actionMerge},
+		{name: "Default Branch Push", event: "push", payload: `{"ref": "refs/heads/main", "after": "abc", ` + repository + `}`, expected: true, refresh: true},
+		{name: "Combined Branch Push", event: "push", payload: `{"ref": "refs/heads/stage", "after": "abc", ` + repository + `}`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			req.Header.Set("X-GitHub-Event", tc.event)
+
+			trigger, ok, err := p.parseWebhook(req, []byte(tc.payload))
+			if err != nil || ok != tc.expected {
+				t.Fatalf("Expected %v, got %v, %v", tc.expected, ok, err)
+			}
+			if !ok {
+				return
+			}
+			if trigger.projectID != 77 || trigger.projectPath != "org/app" || trigger.refreshes(trigger.profiles[0]) != tc.refresh || trigger.action != tc.action {
+				t.Errorf("Unexpected trigger %+v", trigger)
+			}
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.Header.Set("X-GitHub-Event", "ping")
+	var unsupported *unsupportedEventError
+	if _, _, err := p.parseWebhook(req, []byte(`{}`)); !errors.As(err, &unsupported) {
+		t.Errorf("Expected ping to be unsupported, got %v", err)
+	}
+
+	body := []byte(`{"action": "labeled"}`)
+	mac := hmac.New(sha256.New, []byte("hook-secret"))
+	mac.Write(body)
+	req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	if err := p.verifyWebhook(req, body, 77); err != nil {
+		t.Errorf("Expected a valid signature, got %v", err)
+	}
+	if err := p.verifyWebhook(req, []byte(`{"action": "unlabeled"}`), 77); err == nil {
+		t.Error("Expected a signature over another body to be rejected")
+	}
+}
+
+func TestGitHubProvider(t *testing.T) {
+	var requests []string
+	var githubServer *httptest.Server
+	githubServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+string(data))
+		if r.Header.Get("Authorization") != "Bearer gh-token" {
+			t.Errorf("Expected the GitHub token, got %q", r.Header.Get("Authorization"))
+		}
+
+		switch {
+		case r.URL.Path == "/repositories/77":
+			w.Write([]byte(`{"id": 77, "full_name": "org/app", "default_branch": "main", "ssh_url": "git@github.com:org/app.git", "clone_url": "https://github.com/org/app.git"}`))
+		case r.URL.Path == "/repositories/77/pulls" && r.URL.Query().Get("page") == "":
+			w.Header().Set("Link", fmt.Sprintf(`<%s/repositories/77/pulls?state=open&per_page=100&page=2>; rel="next"`, githubServer.URL))
+			w.Write([]byte(`[{"number": 1, "title": "Labeled", "labels": [{"name": "stage-pr"}], "user": {"login": "alice"},
+				"head": {"ref": "feature", "sha": "abc", "repo": {"id": 88}}, "base": {"ref": "main", "repo": {"id": 77}}},
+				{"number": 2, "title": "Unlabeled", "labels": []}]`))
+		case r.URL.Path == "/repositories/77/pulls":
+			w.Write([]byte(`[{"number": 3, "title": "Second page", "labels": [{"name": "stage-pr"}]}]`))
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer githubServer.Close()
+
+	setConfig(t, &config.GithubAPIURL, githubServer.URL)
+	setConfig(t, &config.GithubToken, "gh-token")
+
+	s := NewServer()
+	p := newGitHubProvider(s)
+	s.forge = p
+	ctx := context.Background()
+
+	repo, err := p.repoInfo(ctx, 77)
+	if err != nil || repo.PathWithNamespace != "org/app" || repo.RepoURL != "git@github.com:org/app.git" || repo.HTTPURL != "https://github.com/org/app.git" {
+		t.Fatalf("Unexpected repo info %+v, %v", repo, err)
+	}
+
+	pulls, err := p.labeledChanges(ctx, 77, "org/app", "stage-pr")
+	if err != nil || len(pulls) != 2 || pulls[0].IID != 1 || pulls[1].IID != 3 {
+		t.Fatalf("Expected the labeled PRs of both pages, got %+v, %v", pulls, err)
+	}
+	if pr := pulls[0]; pr.SHA != "abc" || pr.SourceBranch != "feature" || pr.SourceProjectID != 88 || pr.TargetProjectID != 77 || pr.Author.Username != "alice" {
+		t.Errorf("Unexpected pull request %+v", pr)
+	}
+
+	requests = nil
+	if err := s.createCommentOnMR(ctx, 77, 1, "Merged", "Report"); err != nil {
+		t.Fatalf("Expected the comment to be posted, got %v", err)
+	}
+	if len(requests) != 1 || !strings.HasPrefix(requests[0], "POST /repositories/77/issues/1/comments {\"body\":\"Report") {
+		t.Errorf("Expected an issue comment, got %v", requests)
+	}
+
+	if p.headRef(1) != "pull/1/head" || p.reference(1) != "#1" {
+		t.Errorf("Unexpected refs %s %s", p.headRef(1), p.reference(1))
+	}
+}
+
+func TestCombineAllMRsWithGitHub(t *testing.T) {
+	dir := t.TempDir()
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@localhost", "-C", dir}, args...)...)
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v, output: %s", args, err, output)
+		}
+		return strings.TrimSpace(string(output))
+	}
+	git("init", "--quiet", "--bare", "origin.git")
+	git("init", "--quiet", "-b", "main", "work")
+	work := func(args ...string) string { return git(append([]string{"-C", "work"}, args...)...) }
+	work("commit", "--quiet", "--allow-empty", "-m", "base")
+	base := work("rev-parse", "HEAD")
+	work("push", "--quiet", "../origin.git", "main")
+	work("commit", "--quiet", "--allow-empty", "-m", "feature")
+	head := work("rev-parse", "HEAD")
+	work("push", "--quiet", "../origin.git", "HEAD:refs/pull/1/head")
+
+	for _, key := range []string{"GIT_AUTHOR_NAME", "GIT_COMMITTER_NAME"} {
+		t.Setenv(key, "test")
+	}
+	for _, key := range []string{"GIT_AUTHOR_EMAIL", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(key, "test@localhost")
+	}
+
+	githubServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repositories/77":
+			fmt.Fprintf(w, `{"id": 77, "full_name": "org/app", "default_branch": "main", "ssh_url": %q}`, filepath.Join(dir, "origin.git"))
+		case "/repositories/77/pulls":
+			fmt.Fprintf(w, `[{"number": 1, "title": "Feature", "labels": [{"name": "combine-stage"}], "head": {"ref": "feature", "sha": %q}}]`, head)
+		case "/repositories/77/branches/main":
+			fmt.Fprintf(w, `{"name": "main", "commit": {"sha": %q}}`, base)
+		case "/repositories/77/pulls/1":
+			w.Write([]byte(`{"number": 1, "mergeable_state": "clean"}`))
+		default:
+			t.Errorf("Unexpected GitHub request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer githubServer.Close()
+
+	setConfig(t, &config.GithubAPIURL, githubServer.URL)
+	setConfig(t, &config.WorkDir, filepath.Join(dir, "work-dir"))
+
+	s := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Unexpected GitLab request %s %s", r.Method, r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+	})
+	s.forge = newGitHubProvider(s)
+
+	job := newCombineJob(77, 0, testProfile("stage"))
+	hasError, err := s.combineAllMRs(job)
+	if err != nil || hasError {
+		t.Fatalf("Expected the combine to succeed, got %v, %v: %s", hasError, err, strings.Join(job.comments, "\n"))
+	}
+
+	if parent := git("-C", "origin.git", "rev-parse", "stage^2"); parent != head {
+		t.Errorf("Expected the PR head %s to be merged into stage, got %s", head, parent)
+	}
+	if subject := git("-C", "origin.git", "log", "-1", "--format=%s", "stage"); subject != "Merge branch 'feature' into stage (#1)" {
+		t.Errorf("Unexpected merge commit subject %q", subject)
+	}
+	if _, err := os.Stat(filepath.Join(config.WorkDir, "project-77", "stage")); !os.IsNotExist(err) {
+		t.Errorf("Expected the clone to be removed after the run, got %v", err)
+	}
+}
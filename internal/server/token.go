@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"gitlab-mr-combiner/internal/config"
+	"gitlab-mr-combiner/internal/gitlab"
+	"gitlab-mr-combiner/internal/metrics"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	tokenDateLayout    = "2006-01-02"
+	tokenRetryInterval = time.Minute
+)
+
+var tokenExpiryDays = metrics.NewGaugeVec("combiner_gitlab_token_expiry_days", "Days until GITLAB_TOKEN expires")
+
+// tokenStatus is the outcome of the last token self-check. Problems make
+// /healthz report unhealthy, warnings do not. A transient check could not
+// reach GitLab and says nothing about the token.
+type tokenStatus struct {
+	CheckedAt time.Time
+	Name      string
+	Scopes    []string
+	ExpiresAt string
+	Problems  []string
+	Warnings  []string
+	transient bool
+}
+
+func (t *tokenStatus) healthy() bool {
+	return len(t.Problems) == 0
+}
+
+// checked tells whether any self-check has come to a verdict yet.
+func (t *tokenStatus) checked() bool {
+	return !t.CheckedAt.IsZero()
+}
+
+// startTokenCheck verifies GITLAB_TOKEN at startup and then every
+// TOKEN_CHECK_INTERVAL, so an expired or under-scoped token is reported
+// before a combine fails on it. A check that could not reach GitLab is
+// repeated after a minute. The checks run in the background so a slow GitLab
+// does not hold up the listener; until the first conclusive one /healthz
+// reports the token as unknown.
+func (s *Server) startTokenCheck() {
+	s.tokenStatus.Store(&tokenStatus{})
+	go func() {
+		status := s.refreshTokenStatus()
+		for {
+			next := config.TokenCheckInterval
+			if status.transient && tokenRetryInterval < next {
+				next = tokenRetryInterval
+			}
+			time.Sleep(next)
+			status = s.refreshTokenStatus()
+		}
+	}()
+}
+
+func (s *Server) refreshTokenStatus() *tokenStatus {
+	ctx, cancel := context.WithTimeout(context.Background(), config.StepTimeout)
+	defer cancel()
+
+	status := s.checkToken(ctx, time.Now())
+	if previous := s.tokenStatus.Load(); status.transient && previous != nil {
+		// Keep the last conclusive verdict, a network blip proves nothing.
+		kept := *previous
+		kept.Warnings = append(slices.Clip(previous.Warnings), status.Warnings...)
+		kept.transient = true
+		status = &kept
+	}
+	s.tokenStatus.Store(status)
+	for _, problem := range status.Problems {
+		log.Errorf("GITLAB_TOKEN self-check: %s", problem)
+	}
+	for _, warning := range status.Warnings {
+		log.Warnf("GITLAB_TOKEN self-check: %s", warning)
+	}
+	if status.healthy() && len(status.Warnings) == 0 {
+		log.Infof("GITLAB_TOKEN self-check passed: scopes %s, expires %s", strings.Join(status.Scopes, ","), valueOr(status.ExpiresAt, "never"))
+	}
+	return status
+}
+
+func (s *Server) checkToken(ctx context.Context, now time.Time) *tokenStatus {
+	status := &tokenStatus{CheckedAt: now.UTC()}
+
+	data, err := s.apiClient.Send(ctx, "GET", "/personal_access_tokens/self", nil)
+	if gitlab.IsNotFound(err) {
+		status.Warnings = append(status.Warnings, "token self-introspection is not supported by this GitLab version, scopes and expiry are not checked")
+		return status
+	}
+	if gitlab.IsUnauthorized(err) || gitlab.IsForbidden(err) {
+		status.Problems = append(status.Problems, fmt.Sprintf("token self-introspection failed: %v", err))
+		return status
+	}
+	if err != nil {
+		status.Warnings = append(status.Warnings, fmt.Sprintf("token self-introspection failed, retrying in %s: %v", tokenRetryInterval, err))
+		status.transient = true
+		return status
+	}
+
+	var token gitlab.Token
+	if err := json.Unmarshal(data, &token); err != nil {
+		status.Problems = append(status.Problems, fmt.Sprintf("invalid token self-introspection response: %v", err))
+		return status
+	}
+	status.Name, status.Scopes, status.ExpiresAt = token.Name, token.Scopes, token.ExpiresAt
+
+	if token.Revoked || !token.Active {
+		status.Problems = append(status.Problems, "token is revoked or inactive")
+	}
+	// Comments and labels need api, which also covers write_repository for
+	// pushes with GIT_TRANSPORT=https.
+	if !slices.Contains(token.Scopes, "api") {
+		status.Problems = append(status.Problems, fmt.Sprintf("token lacks the api scope, it has %s", valueOr(strings.Join(token.Scopes, ", "), "none")))
+	}
+
+	if token.ExpiresAt != "" {
+		expiresAt, err := time.Parse(tokenDateLayout, token.ExpiresAt)
+		if err != nil {
+			status.Warnings = append(status.Warnings, fmt.Sprintf("unknown expiry date %q", token.ExpiresAt))
+			return status
+		}
+
+		// Tokens expire at the start of their expiry date (UTC).
+		days := int(expiresAt.Sub(now.UTC()).Hours() / 24)
+		tokenExpiryDays.Set(float64(days))
+		switch {
+		case !now.Before(expiresAt):
+			status.Problems = append(status.Problems, fmt.Sprintf("token expired on %s", token.ExpiresAt))
+		case days < config.TokenExpiryWarningDays:
+			status.Warnings = append(status.Warnings, fmt.Sprintf("token expires on %s, in %d days", token.ExpiresAt, days))
+		}
+	}
+	return status
+}
+
+// handleHealth reports 503 while the last token self-check found a problem
+// and "unknown" before the first check has come to a verdict. The details are
+// only logged, /healthz is unauthenticated.
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	status := s.tokenStatus.Load()
+	if status != nil && !status.healthy() {
+		s.RespondWithJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unhealthy"})
+		return
+	}
+	if status != nil && !status.checked() {
+		s.RespondWithJSON(w, http.StatusOK, map[string]string{"status": "unknown"})
+		return
+	}
+	s.RespondWithJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func valueOr(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+)
+
+// systemCABundles are the usual locations of the distribution CA bundle.
+var systemCABundles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",
+	"/etc/pki/tls/certs/ca-bundle.crt",
+	"/etc/ssl/ca-bundle.pem",
+	"/etc/ssl/cert.pem",
+}
+
+// WriteCABundle writes the system CA bundle followed by extra into one file.
+// git's http.sslCAInfo replaces the system roots instead of adding to them,
+// so the extra CAs alone would break every other HTTPS remote.
+func WriteCABundle(extra []string) (string, error) {
+	var bundle []byte
+	for _, path := range systemCABundles {
+		if data, err := os.ReadFile(path); err == nil {
+			bundle = append(bundle, data...)
+			bundle = append(bundle, '\n')
+			break
+		}
+	}
+
+	for _, path := range extra {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("error reading CA bundle: %v", err)
+		}
+		bundle = append(bundle, data...)
+		bundle = append(bundle, '\n')
+	}
+
+	// A fresh private directory per process keeps other users from swapping
+	// the file under git and replicas sharing /tmp from overwriting it.
+	dir, err := os.MkdirTemp("", "gitlab-combiner-")
+	if err != nil {
+		return "", fmt.Errorf("error writing CA bundle: %v", err)
+	}
+	file, err := os.CreateTemp(dir, "ca-*.pem")
+	if err != nil {
+		return "", fmt.Errorf("error writing CA bundle: %v", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(bundle); err != nil {
+		return "", fmt.Errorf("error writing CA bundle: %v", err)
+	}
+	return file.Name(), nil
+}
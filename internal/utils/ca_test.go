@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteCABundle(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+
+	extra := filepath.Join(t.TempDir(), "extra.pem")
+	if err := os.WriteFile(extra, []byte("EXTRA CA"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := WriteCABundle([]string{extra})
+	if err != nil {
+		t.Fatalf("WriteCABundle failed: %v", err)
+	}
+	second, err := WriteCABundle([]string{extra})
+	if err != nil {
+		t.Fatalf("WriteCABundle failed: %v", err)
+	}
+	if first == second {
+		t.Errorf("Expected every call to get its own file, both wrote %s", first)
+	}
+
+	data, err := os.ReadFile(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "EXTRA CA") {
+		t.Errorf("Expected the bundle to contain the extra CA, got %q", data)
+	}
+
+	for path, want := range map[string]os.FileMode{first: 0o600, filepath.Dir(first): 0o700} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != want {
+			t.Errorf("Expected %s to have mode %v, got %v", path, want, info.Mode().Perm())
+		}
+	}
+}
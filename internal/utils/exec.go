@@ -0,0 +1,18 @@
+package utils
+
+import (
+	"context"
+	"os/exec"
+	"time"
+)
+
+const killWaitDelay = 5 * time.Second
+
+// CommandContext builds a command that is killed together with all of its
+// children (ssh, git-remote-https, ...) once ctx is done.
+func CommandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	setProcessGroup(cmd)
+	cmd.WaitDelay = killWaitDelay
+	return cmd
+}
@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"gitlab-mr-combiner/internal/config"
+)
+
+// GitCommandContext runs git like CommandContext. In the https transport the
+// forge token is handed to git as an http.extraHeader through the
+// GIT_CONFIG_* environment, so it never shows up in arguments, on disk or in
+// remote URLs, and is only sent to GITLAB_URL (GITHUB_URL). The SSH session
+// attached to ctx, if any, is applied as well.
+func GitCommandContext(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := CommandContext(ctx, "git", args...)
+
+	env := gitEnvFrom(ctx)
+	if config.GitTransport == config.GitTransportHTTPS {
+		credentials := "oauth2:" + config.GitlabToken
+		if config.Forge == config.ForgeGitHub {
+			credentials = "x-access-token:" + config.GithubToken
+		}
+		env = append(env, gitConfigEnv(map[string]string{
+			"http." + config.ForgeURL() + ".extraHeader": "Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(credentials)),
+		})...)
+	}
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	return cmd
+}
+
+// gitConfigEnv appends entries to the GIT_CONFIG_COUNT list that may already
+// be set in the environment.
+func gitConfigEnv(entries map[string]string) []string {
+	count, _ := strconv.Atoi(os.Getenv("GIT_CONFIG_COUNT"))
+
+	var env []string
+	for key, value := range entries {
+		env = append(env,
+			fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", count, key),
+			fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", count, value))
+		count++
+	}
+	return append(env, fmt.Sprintf("GIT_CONFIG_COUNT=%d", count))
+}
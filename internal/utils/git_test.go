@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitlab-mr-combiner/internal/config"
+)
+
+func TestGitCommandContextInjectsToken(t *testing.T) {
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	setConfig(t, &config.GitlabURL, server.URL+"/")
+	setConfig(t, &config.GitlabToken, "glpat-secret")
+	setConfig(t, &config.GitTransport, config.GitTransportHTTPS)
+
+	t.Setenv("GIT_CONFIG_COUNT", "1")
+	t.Setenv("GIT_CONFIG_KEY_0", "core.askPass")
+	t.Setenv("GIT_CONFIG_VALUE_0", "true")
+
+	cmd := GitCommandContext(context.Background(), "ls-remote", server.URL+"/group/app.git")
+	output, _ := cmd.CombinedOutput()
+
+	expected := "Basic " + base64.StdEncoding.EncodeToString([]byte("oauth2:glpat-secret"))
+	if authorization != expected {
+		t.Errorf("Expected git to send %q, got %q (output: %s)", expected, authorization, output)
+	}
+	if strings.Contains(strings.Join(cmd.Args, " "), "glpat-secret") || strings.Contains(string(output), "glpat-secret") {
+		t.Error("Expected the token to stay out of the arguments and output")
+	}
+	if !strings.Contains(strings.Join(cmd.Env, "\n"), "GIT_CONFIG_COUNT=2") {
+		t.Error("Expected existing GIT_CONFIG_* entries to be kept")
+	}
+}
+
+func TestInitGitConfigScopesToForge(t *testing.T) {
+	t.Setenv("GIT_CONFIG_GLOBAL", filepath.Join(t.TempDir(), "gitconfig"))
+	setConfig(t, &config.Forge, config.ForgeGitHub)
+	setConfig(t, &config.GithubURL, "https://github.example.com/")
+	setConfig(t, &config.GitlabProxy, "http://proxy.example.com:3128")
+
+	InitGitConfig()
+
+	output, err := exec.Command("git", "config", "--global", "--get-urlmatch", "http.proxy", "https://github.example.com/org/app.git").Output()
+	if err != nil || strings.TrimSpace(string(output)) != config.GitlabProxy {
+		t.Errorf("Expected the proxy to apply to GITHUB_URL, got %q, %v", output, err)
+	}
+	if output, _ := exec.Command("git", "config", "--global", "--get-urlmatch", "http.proxy", config.GitlabURL).Output(); len(output) != 0 {
+		t.Errorf("Expected GITLAB_URL to keep the default proxy, got %q", output)
+	}
+}
+
+// setConfig sets a config variable for the duration of the test.
+func setConfig[T any](t *testing.T, variable *T, value T) {
+	previous := *variable
+	*variable = value
+	t.Cleanup(func() { *variable = previous })
+}
@@ -0,0 +1,214 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"gitlab-mr-combiner/internal/config"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const keyscanTimeout = 30 * time.Second
+
+// managedSSH holds the key and pinned known_hosts loaded at startup. It is
+// nil when git uses the SSH setup of the container (~/.ssh, ssh_config).
+var managedSSH *sshSettings
+
+type sshSettings struct {
+	key        []byte
+	knownHosts []byte
+}
+
+type hostKey struct {
+	line        string
+	fingerprint string
+}
+
+type gitEnvKey struct{}
+
+// InitSSH loads SSH_PRIVATE_KEY(_FILE) and the host keys of the GitLab SSH
+// host. Host keys come from SSH_KNOWN_HOSTS(_FILE) or from ssh-keyscan, and
+// only keys matching SSH_HOST_FINGERPRINTS are kept when pins are set.
+func InitSSH() error {
+	key, err := valueOrFile(config.SSHPrivateKey, config.SSHPrivateKeyFile)
+	if err != nil {
+		return fmt.Errorf("error reading SSH_PRIVATE_KEY_FILE: %v", err)
+	}
+	if len(key) == 0 {
+		return nil
+	}
+	if !bytes.HasSuffix(key, []byte("\n")) {
+		key = append(key, '\n')
+	}
+
+	host, port, err := sshHost()
+	if err != nil {
+		return err
+	}
+
+	knownHosts, err := valueOrFile(config.SSHKnownHosts, config.SSHKnownHostsFile)
+	if err != nil {
+		return fmt.Errorf("error reading SSH_KNOWN_HOSTS_FILE: %v", err)
+	}
+
+	var keys []hostKey
+	if len(knownHosts) > 0 {
+		keys = parseKnownHosts(knownHosts)
+	} else {
+		if len(config.SSHHostFingerprints) == 0 {
+			return fmt.Errorf("SSH_PRIVATE_KEY requires SSH_KNOWN_HOSTS or SSH_HOST_FINGERPRINTS to verify %s", host)
+		}
+		if keys, err = scanHostKeys(host, port); err != nil {
+			return err
+		}
+	}
+
+	if len(config.SSHHostFingerprints) > 0 {
+		var pinned []hostKey
+		var offered []string
+		for _, key := range keys {
+			offered = append(offered, key.fingerprint)
+			if slices.Contains(config.SSHHostFingerprints, key.fingerprint) {
+				pinned = append(pinned, key)
+			}
+		}
+		if len(pinned) == 0 {
+			return fmt.Errorf("host key fingerprint mismatch for %s: got %s, expected one of %s",
+				host, strings.Join(offered, ", "), strings.Join(config.SSHHostFingerprints, ", "))
+		}
+		keys = pinned
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no host keys found for %s", host)
+	}
+
+	var lines []string
+	for _, key := range keys {
+		lines = append(lines, key.line)
+		log.Infof("Trusting SSH host key %s for %s", key.fingerprint, host)
+	}
+	managedSSH = &sshSettings{key: key, knownHosts: []byte(strings.Join(lines, "\n") + "\n")}
+	return nil
+}
+
+func valueOrFile(value, path string) ([]byte, error) {
+	if path != "" {
+		return os.ReadFile(path)
+	}
+	return []byte(value), nil
+}
+
+// sshHost returns SSH_HOST, or the host of GITLAB_URL (GITHUB_URL) on port 22.
+func sshHost() (string, string, error) {
+	if config.SSHHost != "" {
+		if host, port, err := net.SplitHostPort(config.SSHHost); err == nil {
+			return host, port, nil
+		}
+		return config.SSHHost, "22", nil
+	}
+
+	parsed, err := url.Parse(config.ForgeURL())
+	if err != nil || parsed.Hostname() == "" {
+		return "", "", fmt.Errorf("cannot derive the SSH host from %s, set SSH_HOST", config.ForgeURL())
+	}
+	return parsed.Hostname(), "22", nil
+}
+
+func scanHostKeys(host, port string) ([]hostKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), keyscanTimeout)
+	defer cancel()
+
+	output, err := CommandContext(ctx, "ssh-keyscan", "-p", port, host).Output()
+	if err != nil {
+		return nil, fmt.Errorf("error scanning host keys of %s: %v", host, err)
+	}
+	return parseKnownHosts(output), nil
+}
+
+// parseKnownHosts reads known_hosts lines ("[marker] hosts keytype key") and
+// computes the OpenSSH SHA256 fingerprint of every key.
+func parseKnownHosts(data []byte) []hostKey {
+	var keys []hostKey
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		fields := strings.Fields(line)
+		if len(fields) > 0 && strings.HasPrefix(fields[0], "@") {
+			fields = fields[1:]
+		}
+		if len(fields) < 3 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		blob, err := base64.StdEncoding.DecodeString(fields[2])
+		if err != nil {
+			continue
+		}
+		sum := sha256.Sum256(blob)
+		keys = append(keys, hostKey{line: line, fingerprint: "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])})
+	}
+	return keys
+}
+
+// SSHSession is the key and known_hosts of one combine run, written to a
+// private temp directory for the lifetime of the run.
+type SSHSession struct {
+	dir string
+	env []string
+}
+
+func NewSSHSession() (*SSHSession, error) {
+	if managedSSH == nil {
+		return &SSHSession{}, nil
+	}
+
+	dir, err := os.MkdirTemp("", "combiner-ssh-")
+	if err != nil {
+		return nil, fmt.Errorf("error creating SSH workspace: %v", err)
+	}
+
+	keyFile := filepath.Join(dir, "id")
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+	if err := os.WriteFile(keyFile, managedSSH.key, 0o600); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("error writing SSH key: %v", err)
+	}
+	if err := os.WriteFile(knownHostsFile, managedSSH.knownHosts, 0o600); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("error writing known_hosts: %v", err)
+	}
+
+	command := fmt.Sprintf("ssh -i '%s' -o IdentitiesOnly=yes -o IdentityAgent=none -o StrictHostKeyChecking=yes -o UserKnownHostsFile='%s' -o GlobalKnownHostsFile=/dev/null", keyFile, knownHostsFile)
+	return &SSHSession{dir: dir, env: []string{"GIT_SSH_COMMAND=" + command}}, nil
+}
+
+// Context makes git commands started with ctx use the session.
+func (s *SSHSession) Context(ctx context.Context) context.Context {
+	if len(s.env) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, gitEnvKey{}, s.env)
+}
+
+func (s *SSHSession) Close() {
+	if s.dir != "" {
+		os.RemoveAll(s.dir)
+	}
+}
+
+func gitEnvFrom(ctx context.Context) []string {
+	env, _ := ctx.Value(gitEnvKey{}).([]string)
+	return env
+}
@@ -19,12 +19,48 @@ func InitLogger() {
 	log.SetOutput(os.Stdout)
 }
 
+// NewAuditLogger writes JSON audit records to path, or to stdout when path is
+// empty.
+func NewAuditLogger(path string) (*log.Logger, error) {
+	logger := log.New()
+	logger.SetFormatter(&log.JSONFormatter{})
+	logger.SetOutput(os.Stdout)
+
+	if path != "" {
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o640)
+		if err != nil {
+			return nil, err
+		}
+		logger.SetOutput(file)
+	}
+	return logger, nil
+}
+
 func InitGitConfig() {
 	commands := [][]string{
 		{"git", "config", "--global", "user.email", config.GitEmail},
 		{"git", "config", "--global", "user.name", config.GitUser},
 	}
 
+	// Transport settings are scoped to the URL of the forge the repositories
+	// are cloned from so other remotes keep the defaults.
+	section := "http." + config.ForgeURL() + "."
+	if len(config.GitlabCABundles) > 0 {
+		bundle, err := WriteCABundle(config.GitlabCABundles)
+		if err != nil {
+			log.Fatalf("Invalid GITLAB_CA_BUNDLE: %v", err)
+		}
+		commands = append(commands, []string{"git", "config", "--global", section + "sslCAInfo", bundle})
+	}
+	if config.GitlabClientCert != "" {
+		commands = append(commands,
+			[]string{"git", "config", "--global", section + "sslCert", config.GitlabClientCert},
+			[]string{"git", "config", "--global", section + "sslKey", config.GitlabClientKey})
+	}
+	if config.GitlabProxy != "" {
+		commands = append(commands, []string{"git", "config", "--global", section + "proxy", config.GitlabProxy})
+	}
+
 	for _, cmd := range commands {
 		if err := exec.Command(cmd[0], cmd[1:]...).Run(); err != nil {
 			log.Fatalf("Failed to run command: %s", cmd)